@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// How long the rumble command rumbles for when no duration is given
+const ADMIN_RUMBLE_DURATION time.Duration = 500 * time.Millisecond
+
+// adminConsole reads commands, one per line, from whoever runs the server.
+// Commands that change the gamepad run on the core so they take effect right away
+func adminConsole(in io.Reader, events chan<- Event) {
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		args := strings.Fields(scanner.Text())
+		if len(args) == 0 {
+			continue
+		}
+
+		switch args[0] {
+		case "next":
+			events <- Event{Kind: EVENT_COMMAND, Command: func(core *Core) {
+				turns, ok := core.Multiplexer.(*TurnMultiplexer)
+				if !ok {
+					log.Println("ADMIN: next only works with the turns multiplexer")
+					return
+				}
+				turns.Pass()
+			}}
+		case "give":
+			if len(args) != 2 {
+				log.Println("ADMIN: usage: give <name>")
+				continue
+			}
+			client := findClient(args[1])
+			if client == nil {
+				log.Printf("ADMIN: no client named %s\n", args[1])
+				continue
+			}
+			events <- Event{Kind: EVENT_COMMAND, Command: func(core *Core) {
+				turns, ok := core.Multiplexer.(*TurnMultiplexer)
+				if !ok {
+					log.Println("ADMIN: give only works with the turns multiplexer")
+					return
+				}
+				turns.Give(client.Id)
+			}}
+		case "rumble":
+			if len(args) < 2 || len(args) > 3 {
+				log.Println("ADMIN: usage: rumble <name|all> [duration]")
+				continue
+			}
+			effect := Rumble{Strong: 0xFFFF, Weak: 0xFFFF, Duration: ADMIN_RUMBLE_DURATION}
+			if len(args) == 3 {
+				duration, err := time.ParseDuration(args[2])
+				if err != nil {
+					log.Printf("ADMIN: bad duration %s\n", args[2])
+					continue
+				}
+				effect.Duration = duration
+			}
+
+			if args[1] == "all" {
+				broadcastRumble(effect)
+				continue
+			}
+			client := findClient(args[1])
+			if client == nil {
+				log.Printf("ADMIN: no client named %s\n", args[1])
+				continue
+			}
+			client.SendRumble(ALL_JOYSTICKS, effect)
+		case "profile":
+			if len(args) > 2 {
+				log.Println("ADMIN: usage: profile [name]")
+				continue
+			}
+			events <- Event{Kind: EVENT_COMMAND, Command: func(core *Core) {
+				if len(args) == 1 {
+					log.Printf("ADMIN: playing %s, profiles are %s\n",
+						core.Profile(), strings.Join(core.ProfileNames(), ", "))
+					return
+				}
+				err := core.SetProfile(args[1])
+				if err != nil {
+					log.Println("ADMIN:", err)
+				}
+			}}
+		case "stats":
+			printStats()
+		case "help":
+			log.Println("ADMIN: commands are next, give <name>, rumble <name|all> [duration], profile [name], stats and help")
+		default:
+			log.Printf("ADMIN: unknown command %s, try help\n", args[0])
+		}
+	}
+}
+
+// printStats shows how healthy the connection to every client is
+func printStats() {
+	clientLock.Lock()
+	defer clientLock.Unlock()
+
+	ids := make([]int, 0, len(clients))
+	for id := range clients {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		client := clients[uint8(id)]
+		stats := client.Link.Stats()
+		log.Printf(
+			"ADMIN: %d %s rtt %s jitter %s loss %.1f%%\n",
+			id, client.Name,
+			stats.RTT.Round(time.Microsecond),
+			stats.Jitter.Round(time.Microsecond),
+			stats.Loss*100,
+		)
+	}
+}
+
+// findClient looks up a connected client by their name
+func findClient(name string) *ServerConn {
+	clientLock.Lock()
+	defer clientLock.Unlock()
+	for _, client := range clients {
+		if client.Name == name {
+			return client
+		}
+	}
+	return nil
+}
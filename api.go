@@ -0,0 +1,377 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-gl/glfw/v3.3/glfw"
+)
+
+// APIClient is how the admin API shows a client
+type APIClient struct {
+	Id              uint8               `json:"id"`
+	Name            string              `json:"name"`
+	Address         string              `json:"address"`
+	DatagramAddress string              `json:"datagram_address,omitempty"`
+	Ready           bool                `json:"ready"`
+	Held            bool                `json:"held"`
+	Version         uint8               `json:"version"`
+	Capabilities    uint32              `json:"capabilities"`
+	RTT             float64             `json:"rtt_ms"`
+	Jitter          float64             `json:"jitter_ms"`
+	Loss            float64             `json:"loss"`
+	Rules           map[string][]string `json:"rules"`
+	// Controllers the client has plugged in
+	Peripherals []APIPeripheral `json:"peripherals"`
+	// Latest state of each joystick, by the same names as the rules
+	Joysticks map[string]glfw.GamepadState `json:"joysticks"`
+}
+
+// APIPeripheral is a controller a client has plugged in
+type APIPeripheral struct {
+	Joystick uint8  `json:"joystick"`
+	GUID     string `json:"guid"`
+	Name     string `json:"name"`
+}
+
+// APIMultiplexer is how the admin API shows and takes a multiplexer, the
+// same fields as the multiplexer section of the config
+type APIMultiplexer struct {
+	Mode       string   `json:"mode"`
+	Quorum     *float32 `json:"quorum,omitempty"`
+	TurnLength string   `json:"turn_length,omitempty"`
+	TurnChord  []string `json:"turn_chord,omitempty"`
+}
+
+// APIProfile is the profile being played and the ones it can switch to
+type APIProfile struct {
+	Profile  string   `json:"profile"`
+	Profiles []string `json:"profiles,omitempty"`
+}
+
+// APIStatus is what the virtual gamepad is up to
+type APIStatus struct {
+	Paused      bool              `json:"paused"`
+	Profile     string            `json:"profile"`
+	Multiplexer APIMultiplexer    `json:"multiplexer"`
+	Gamepad     glfw.GamepadState `json:"gamepad"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// serveAPI takes admin requests over HTTP. Everything the console can do and
+// more, for tools and dashboards. Requests need the token when there is one
+func serveAPI(addr, token string, rules ClientsMap) {
+	if token == "" {
+		log.Println("The admin API has no token, anyone who can reach it can control the server")
+	}
+
+	log.Printf("Admin API listening on %s\n", addr)
+	err := http.ListenAndServe(addr, apiHandler(token, rules))
+	if err != nil {
+		log.Fatalln("Failed to serve the admin API due to error:", err)
+	}
+}
+
+// apiHandler routes admin requests behind the token
+func apiHandler(token string, rules ClientsMap) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/clients", apiClients)
+	mux.HandleFunc("/clients/", func(w http.ResponseWriter, r *http.Request) {
+		apiClient(w, r, rules)
+	})
+	mux.HandleFunc("/multiplexer", apiMultiplexer)
+	mux.HandleFunc("/profile", apiProfile)
+	mux.HandleFunc("/pause", func(w http.ResponseWriter, r *http.Request) {
+		apiPause(w, r, true)
+	})
+	mux.HandleFunc("/resume", func(w http.ResponseWriter, r *http.Request) {
+		apiPause(w, r, false)
+	})
+	mux.HandleFunc("/status", apiStatus)
+	return apiAuth(token, mux)
+}
+
+// apiAuth turns away requests without the right bearer token. The scheme is
+// case insensitive like the rest of HTTP, but it has to be there
+func apiAuth(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" {
+			const scheme = "Bearer "
+			header := r.Header.Get("Authorization")
+			given := ""
+			if len(header) > len(scheme) && strings.EqualFold(header[:len(scheme)], scheme) {
+				given = header[len(scheme):]
+			}
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				apiReply(w, http.StatusUnauthorized, apiError{"bad or missing token"})
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func apiReply(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func apiFail(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	apiReply(w, status, apiError{fmt.Sprintf(format, args...)})
+}
+
+func apiMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	apiFail(w, http.StatusMethodNotAllowed, "%s is not allowed here", r.Method)
+}
+
+// GET /clients lists every client with their connection, rules and joysticks
+func apiClients(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apiMethodNotAllowed(w, r)
+		return
+	}
+
+	// The joysticks belong to the core, take a copy of them
+	states := make(StatesMap)
+	runOnCore(func(core *Core) {
+		for id, state := range core.states {
+			states[id] = state
+		}
+	})
+
+	clientLock.Lock()
+	list := make([]APIClient, 0, len(clients))
+	for _, client := range clients {
+		stats := client.Link.Stats()
+		info := APIClient{
+			Id:           client.Id,
+			Name:         client.Name,
+			Address:      client.Conn.RemoteAddr().String(),
+			Ready:        client.Ready,
+			Held:         client.held,
+			Version:      client.Version,
+			Capabilities: client.Capabilities,
+			RTT:          float64(stats.RTT) / float64(time.Millisecond),
+			Jitter:       float64(stats.Jitter) / float64(time.Millisecond),
+			Loss:         stats.Loss,
+			Rules:        ruleNamesOf(client.Rules[client.Name]),
+			Joysticks:    make(map[string]glfw.GamepadState),
+		}
+		for _, peripheral := range client.peripherals {
+			info.Peripherals = append(info.Peripherals, APIPeripheral(peripheral))
+		}
+		sort.Slice(info.Peripherals, func(i, j int) bool {
+			return info.Peripherals[i].Joystick < info.Peripherals[j].Joystick
+		})
+		if client.DatagramAddr != nil {
+			info.DatagramAddress = client.DatagramAddr.String()
+		}
+		for id, state := range states {
+			if id.Client == client.Id {
+				info.Joysticks[fmt.Sprintf("joystick%d", id.Device)] = state
+			}
+		}
+		list = append(list, info)
+	}
+	clientLock.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	apiReply(w, http.StatusOK, list)
+}
+
+// DELETE /clients/<name> kicks a client and PUT /clients/<name>/rules changes
+// what their joysticks can press
+func apiClient(w http.ResponseWriter, r *http.Request, rules ClientsMap) {
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, "/clients/"), "/")
+	name := path[0]
+
+	switch {
+	case len(path) == 1 && r.Method == http.MethodDelete:
+		client := findClient(name)
+		if client == nil {
+			apiFail(w, http.StatusNotFound, "no client named %s", name)
+			return
+		}
+		client.Kick("kicked by an admin")
+		w.WriteHeader(http.StatusNoContent)
+	case len(path) == 2 && path[1] == "rules" && r.Method == http.MethodPut:
+		var names map[string][]string
+		err := json.NewDecoder(r.Body).Decode(&names)
+		if err != nil {
+			apiFail(w, http.StatusBadRequest, "bad rules: %s", err)
+			return
+		}
+		selectors, err := parseSelectorMap(names)
+		if err != nil {
+			apiFail(w, http.StatusBadRequest, "bad rules: %s", err)
+			return
+		}
+
+		clientLock.Lock()
+		_, exists := rules[name]
+		clientLock.Unlock()
+		if !exists {
+			apiFail(w, http.StatusNotFound, "no client named %s in the config", name)
+			return
+		}
+
+		setRules(rules, name, selectors)
+		log.Printf("ADMIN: changed the rules of %s\n", name)
+		apiReply(w, http.StatusOK, ruleNamesOf(selectors))
+	case len(path) == 1 || len(path) == 2 && path[1] == "rules":
+		apiMethodNotAllowed(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// GET /multiplexer shows how the joysticks are merged and PUT swaps it
+func apiMultiplexer(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		var config APIMultiplexer
+		runOnCore(func(core *Core) {
+			config = apiMultiplexerOf(core.Multiplexer)
+		})
+		apiReply(w, http.StatusOK, config)
+	case http.MethodPut:
+		var config APIMultiplexer
+		err := json.NewDecoder(r.Body).Decode(&config)
+		if err != nil {
+			apiFail(w, http.StatusBadRequest, "bad multiplexer: %s", err)
+			return
+		}
+
+		multiplexerConfig := MultiplexerConfig{
+			Mode:      config.Mode,
+			Quorum:    config.Quorum,
+			TurnChord: config.TurnChord,
+		}
+		if config.TurnLength != "" {
+			multiplexerConfig.TurnLength, err = time.ParseDuration(config.TurnLength)
+			if err != nil {
+				apiFail(w, http.StatusBadRequest, "bad turn length %s", config.TurnLength)
+				return
+			}
+		}
+		multiplexer, err := newMultiplexer(multiplexerConfig)
+		if err != nil {
+			apiFail(w, http.StatusBadRequest, "bad multiplexer: %s", err)
+			return
+		}
+
+		runOnCore(func(core *Core) {
+			core.SetMultiplexer(multiplexer)
+			config = apiMultiplexerOf(core.Multiplexer)
+		})
+		log.Printf("ADMIN: switched to the %s multiplexer\n", config.Mode)
+		apiReply(w, http.StatusOK, config)
+	default:
+		apiMethodNotAllowed(w, r)
+	}
+}
+
+// apiMultiplexerOf describes a multiplexer the way the config would
+func apiMultiplexerOf(multiplexer Multiplexer) (config APIMultiplexer) {
+	switch m := multiplexer.(type) {
+	case AverageMultiplexer:
+		config.Mode = MULTIPLEX_AVERAGE
+	case OrMultiplexer:
+		config.Mode = MULTIPLEX_OR
+	case VoteMultiplexer:
+		config.Mode = MULTIPLEX_VOTE
+		quorum := m.Quorum
+		config.Quorum = &quorum
+	case StrongestMultiplexer:
+		config.Mode = MULTIPLEX_STRONGEST
+	case *FirstMultiplexer:
+		config.Mode = MULTIPLEX_FIRST
+	case *TurnMultiplexer:
+		config.Mode = MULTIPLEX_TURNS
+		config.TurnLength = m.TurnLength.String()
+		for _, button := range m.Chord {
+			config.TurnChord = append(config.TurnChord, ruleNames[MultiplexRule{Button, button, 0}])
+		}
+	}
+	return config
+}
+
+// GET /profile shows the game being played and PUT switches to another one
+func apiProfile(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		var profile APIProfile
+		runOnCore(func(core *Core) {
+			profile = APIProfile{core.Profile(), core.ProfileNames()}
+		})
+		apiReply(w, http.StatusOK, profile)
+	case http.MethodPut:
+		var profile APIProfile
+		err := json.NewDecoder(r.Body).Decode(&profile)
+		if err != nil {
+			apiFail(w, http.StatusBadRequest, "bad profile: %s", err)
+			return
+		}
+
+		runOnCore(func(core *Core) {
+			err = core.SetProfile(profile.Profile)
+			profile = APIProfile{core.Profile(), core.ProfileNames()}
+		})
+		if err != nil {
+			apiFail(w, http.StatusNotFound, "%s", err)
+			return
+		}
+		log.Printf("ADMIN: switched to the %s profile\n", profile.Profile)
+		apiReply(w, http.StatusOK, profile)
+	default:
+		apiMethodNotAllowed(w, r)
+	}
+}
+
+// POST /pause lets go of everything on the virtual gamepad until POST /resume
+func apiPause(w http.ResponseWriter, r *http.Request, paused bool) {
+	if r.Method != http.MethodPost {
+		apiMethodNotAllowed(w, r)
+		return
+	}
+
+	runOnCore(func(core *Core) {
+		core.Paused = paused
+	})
+	if paused {
+		log.Println("ADMIN: paused the gamepad")
+	} else {
+		log.Println("ADMIN: resumed the gamepad")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /status shows the virtual gamepad
+func apiStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apiMethodNotAllowed(w, r)
+		return
+	}
+
+	var status APIStatus
+	runOnCore(func(core *Core) {
+		status.Paused = core.Paused
+		status.Profile = core.Profile()
+		status.Multiplexer = apiMultiplexerOf(core.Multiplexer)
+		status.Gamepad = core.multiplexed
+		if core.Paused {
+			status.Gamepad = resting
+		}
+	})
+	apiReply(w, http.StatusOK, status)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// apiRequest sends a request to the admin API and returns the status it answered with
+func apiRequest(t *testing.T, server *httptest.Server, method, path, auth, body string) int {
+	t.Helper()
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestAPIAuth(t *testing.T) {
+	server := httptest.NewServer(apiHandler("tok", ClientsMap{}))
+	defer server.Close()
+
+	tests := []struct {
+		auth string
+		want int
+	}{
+		{"", http.StatusUnauthorized},
+		{"tok", http.StatusUnauthorized},
+		{"Basic tok", http.StatusUnauthorized},
+		{"Bearer", http.StatusUnauthorized},
+		{"Bearer ", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Bearer tokk", http.StatusUnauthorized},
+		{"Bearer tok", http.StatusNotFound},
+		{"bearer tok", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		// Nobody is connected, so getting past the token finds nobody to kick
+		if got := apiRequest(t, server, http.MethodDelete, "/clients/nobody", test.auth, ""); got != test.want {
+			t.Errorf("Authorization %q answered %d, want %d", test.auth, got, test.want)
+		}
+	}
+
+	open := httptest.NewServer(apiHandler("", ClientsMap{}))
+	defer open.Close()
+	if got := apiRequest(t, open, http.MethodDelete, "/clients/nobody", "", ""); got != http.StatusNotFound {
+		t.Errorf("API without a token answered %d, want %d", got, http.StatusNotFound)
+	}
+}
+
+func TestAPIKick(t *testing.T) {
+	server := httptest.NewServer(apiHandler("", ClientsMap{}))
+	defer server.Close()
+
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+	client := &ServerConn{Id: 250, Name: "kickme", Conn: NewControlStream(serverSide)}
+	clientLock.Lock()
+	clients[client.Id] = client
+	clientLock.Unlock()
+
+	done := make(chan *ControlProtocol, 1)
+	go func() {
+		pkt, err := NewControlStream(clientSide).ReadPacket()
+		if err == nil {
+			done <- pkt
+		}
+	}()
+
+	if got := apiRequest(t, server, http.MethodDelete, "/clients/kickme", "", ""); got != http.StatusNoContent {
+		t.Fatalf("kick answered %d, want %d", got, http.StatusNoContent)
+	}
+	select {
+	case pkt := <-done:
+		if pkt.Type != DONE || string(pkt.Data) != "kicked by an admin" {
+			t.Errorf("kicked client got %+v, want DONE with the reason", pkt)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("kicked client was never told")
+	}
+	if findClient("kickme") != nil {
+		t.Error("kicked client is still connected")
+	}
+
+	if got := apiRequest(t, server, http.MethodDelete, "/clients/kickme", "", ""); got != http.StatusNotFound {
+		t.Errorf("kicking them again answered %d, want %d", got, http.StatusNotFound)
+	}
+}
+
+func TestAPIRules(t *testing.T) {
+	original, err := parseSelectorMap(map[string][]string{"joystick0": {"BUTTON_A", "BUTTON_B"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := ClientsMap{"amy": original}
+	server := httptest.NewServer(apiHandler("", rules))
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{"unknown rule", http.MethodPut, "/clients/amy/rules", `{"joystick0": ["BUTTON_Z"]}`, http.StatusBadRequest},
+		{"bad joystick", http.MethodPut, "/clients/amy/rules", `{"joystick16": ["BUTTON_A"]}`, http.StatusBadRequest},
+		{"not json", http.MethodPut, "/clients/amy/rules", `joystick0: [BUTTON_A]`, http.StatusBadRequest},
+		{"not in the config", http.MethodPut, "/clients/bob/rules", `{"joystick0": ["BUTTON_A"]}`, http.StatusNotFound},
+		{"wrong method", http.MethodGet, "/clients/amy/rules", "", http.StatusMethodNotAllowed},
+		{"wrong path", http.MethodPut, "/clients/amy/mouse", `{}`, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := apiRequest(t, server, test.method, test.path, "", test.body); got != test.want {
+				t.Fatalf("answered %d, want %d", got, test.want)
+			}
+			clientLock.Lock()
+			defer clientLock.Unlock()
+			if !reflect.DeepEqual(rules["amy"], original) {
+				t.Fatalf("rules changed to %v", rules["amy"])
+			}
+		})
+	}
+
+	body := `{"joystick0": ["BUTTON_X"], "joystick1": ["AXIS_LEFT_X", "AXIS_LEFT_Y"]}`
+	if got := apiRequest(t, server, http.MethodPut, "/clients/amy/rules", "", body); got != http.StatusOK {
+		t.Fatalf("changing the rules answered %d, want %d", got, http.StatusOK)
+	}
+	want, _ := parseSelectorMap(map[string][]string{
+		"joystick0": {"BUTTON_X"},
+		"joystick1": {"AXIS_LEFT_X", "AXIS_LEFT_Y"},
+	})
+	clientLock.Lock()
+	defer clientLock.Unlock()
+	if !reflect.DeepEqual(rules["amy"], want) {
+		t.Errorf("rules are %v, want %v", rules["amy"], want)
+	}
+}
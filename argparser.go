@@ -1,29 +1,63 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
-	"strings"
+	"sort"
+	"time"
 
 	"github.com/alecthomas/kong"
 	"github.com/go-gl/glfw/v3.3/glfw"
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
 )
 
 // CommandLine is used to define flags when calling the program
 type CommandLine struct {
-	Config  string `short:"c" help:"Configuration file location" default:"configs/gpmux.yml"`
-	Listen  bool   `short:"l" help:"Specify whether to listen as a server rather than connect"`
-	Domain  string `short:"d" help:"The ip or domain to use" default:"localhost"`
-	Port    uint16 `short:"p" help:"The port to use" default:"14695"`
-	Name    string `short:"n" help:"The name of the client" default:"client"`
-	Verbose bool   `short:"v" help:"Increase verbosity level"`
+	Config    string        `short:"c" help:"Configuration file location" default:"configs/gpmux.yml"`
+	Listen    bool          `short:"l" help:"Specify whether to listen as a server rather than connect"`
+	Check     bool          `help:"Check the configuration file for errors and exit"`
+	Domain    string        `short:"d" help:"The ip or domain to use" default:"localhost"`
+	Port      uint16        `short:"p" help:"The port to use" default:"14695"`
+	Name      string        `short:"n" help:"The name of the client" default:"client"`
+	Verbose   bool          `short:"v" help:"Increase verbosity level"`
+	Output    string        `short:"o" help:"Where the server sends the multiplexed gamepad, keyboard or gamepad" enum:"keyboard,gamepad" default:"keyboard"`
+	Uinput    string        `help:"The uinput device used by the gamepad output" default:"/dev/uinput"`
+	Secret    string        `short:"s" help:"Passphrase shared by the server and clients to protect the key exchange" env:"GPMUX_SECRET"`
+	Encrypt   bool          `short:"e" help:"Refuse to connect without encryption"`
+	Timeout   time.Duration `help:"How long a client can go quiet before the server lets go of its inputs" default:"1s"`
+	Evict     time.Duration `help:"How long a client can go quiet before the server forgets its state" default:"30s"`
+	Grace     time.Duration `help:"How long the server holds the id of a disconnected client so it can reconnect" default:"30s"`
+	Rate      uint          `help:"How many times a second clients send joysticks that are moving" default:"60"`
+	Keepalive time.Duration `help:"How often clients resend joysticks nobody is touching, keep it under the server's timeout" default:"250ms"`
+	Profile   string        `help:"Profile the server starts with instead of the one the config picks"`
+	Haptics   string        `help:"Where clients play rumble from the server, device, fake or off" enum:"device,fake,off" default:"device"`
+	API       string        `help:"Address the server takes admin requests over HTTP on, like localhost:14696, off when empty"`
+	APIToken  string        `help:"Bearer token admin requests must carry" env:"GPMUX_API_TOKEN"`
+}
+
+// Security is how the command line asked to protect the connection. A
+// secret is no use without encryption, so setting one requires it too
+func (cli CommandLine) Security() Security {
+	return Security{
+		Secret:   []byte(cli.Secret),
+		Required: cli.Encrypt || cli.Secret != "",
+	}
+}
+
+// Tick is how long clients wait between sending moving joysticks
+func (cli CommandLine) Tick() time.Duration {
+	return time.Second / time.Duration(cli.Rate)
 }
 
 // Parse the command line arguments
 // This should only be called from the main Parse method in this package
 func argParse() (cli CommandLine) {
 	ctx := kong.Parse(&cli)
+	if cli.Rate == 0 {
+		ctx.Fatalf("--rate must be at least 1")
+	}
 	switch ctx.Command() {
 	// case "config":
 	// 	log.Println("Foo")
@@ -32,7 +66,7 @@ func argParse() (cli CommandLine) {
 	}
 }
 
-type ClientsMap map[string]RulesMap
+type ClientsMap map[string]SelectorMap
 type RulesMap map[glfw.Joystick][]MultiplexRule
 type ButtonMap map[glfw.GamepadButton]MapRule
 type AxisMap map[glfw.GamepadAxis]MapRule
@@ -48,137 +82,276 @@ type MapRule struct {
 	Key1 string
 }
 
+// Mapping is how the multiplexed gamepad turns into keyboard and mouse events
+type Mapping struct {
+	Buttons ButtonMap
+	Axes    AxisMap
+	Mouse   MouseConfig
+}
+
 const (
 	Button = iota
 	Axis
 )
 
 type Config struct {
-	Clients map[string]map[string][]string `yaml:"clients"`
-	Mapping map[string]string              `yaml:"mapping"`
+	Clients     map[string]map[string][]string `yaml:"clients"`
+	Mapping     map[string]string              `yaml:"mapping"`
+	Multiplexer MultiplexerConfig              `yaml:"multiplexer"`
+	Mouse       MouseOptions                   `yaml:"mouse"`
+	// How each client's axes are shaped, client -> axis -> response
+	Axes map[string]map[string]AxisOptions `yaml:"axes"`
+	// Settings for each game, anything a profile leaves out comes from above
+	Profiles     map[string]ProfileConfig `yaml:"profiles"`
+	Profile      string                   `yaml:"profile"`
+	ProfileChord []string                 `yaml:"profile_chord"`
+}
+
+type ProfileConfig struct {
+	Mapping     map[string]string  `yaml:"mapping"`
+	Multiplexer *MultiplexerConfig `yaml:"multiplexer"`
+	Mouse       *MouseOptions      `yaml:"mouse"`
+	// Axes the profile shapes differently, on top of the axes section
+	Axes map[string]map[string]AxisOptions `yaml:"axes"`
+}
+
+// MultiplexerConfig picks the multiplexer. Quorum is nil when it's left out
+// so a quorum of 0, where any one voter presses a button, still works
+type MultiplexerConfig struct {
+	Mode       string        `yaml:"mode"`
+	Quorum     *float32      `yaml:"quorum"`
+	TurnLength time.Duration `yaml:"turn_length"`
+	TurnChord  []string      `yaml:"turn_chord"`
+}
+
+type MouseConfig struct {
+	// Pixels the mouse moves every interval with the stick pushed all the way
+	Sensitivity float32
+	// Exponent of the response curve, 1 is linear and bigger is finer near the center
+	Acceleration float32
+	// How far the stick has to move before the mouse does
+	Deadzone float32
+}
+
+// MouseOptions is the mouse section as it's written in the config. Settings
+// that are left out are nil so they can be told apart from ones set to 0
+type MouseOptions struct {
+	Sensitivity  *float32 `yaml:"sensitivity"`
+	Acceleration *float32 `yaml:"acceleration"`
+	Deadzone     *float32 `yaml:"deadzone"`
 }
 
-func stringToRule(rule string) MultiplexRule {
+// Mouse settings used when the config leaves them out
+const (
+	DEFAULT_MOUSE_SENSITIVITY  float32 = 20
+	DEFAULT_MOUSE_ACCELERATION float32 = 1
+)
+
+// The mouse settings of a config without a mouse section
+var defaultMouse = MouseConfig{DEFAULT_MOUSE_SENSITIVITY, DEFAULT_MOUSE_ACCELERATION, STICK_DEADZONE}
+
+// parseRule parses the name of a button or axis
+func parseRule(rule string) (MultiplexRule, error) {
 	switch rule {
 	case "BUTTON_CROSS":
 		fallthrough
 	case "BUTTON_A":
-		return MultiplexRule{Button, glfw.ButtonA, 0}
+		return MultiplexRule{Button, glfw.ButtonA, 0}, nil
 	case "BUTTON_CIRCLE":
 		fallthrough
 	case "BUTTON_B":
-		return MultiplexRule{Button, glfw.ButtonB, 0}
+		return MultiplexRule{Button, glfw.ButtonB, 0}, nil
 	case "BUTTON_SQUARE":
 		fallthrough
 	case "BUTTON_X":
-		return MultiplexRule{Button, glfw.ButtonX, 0}
+		return MultiplexRule{Button, glfw.ButtonX, 0}, nil
 	case "BUTTON_TRIANGLE":
 		fallthrough
 	case "BUTTON_Y":
-		return MultiplexRule{Button, glfw.ButtonY, 0}
+		return MultiplexRule{Button, glfw.ButtonY, 0}, nil
 	case "BUTTON_LEFT_BUMPER":
-		return MultiplexRule{Button, glfw.ButtonLeftBumper, 0}
+		return MultiplexRule{Button, glfw.ButtonLeftBumper, 0}, nil
 	case "BUTTON_RIGHT_BUMPER":
-		return MultiplexRule{Button, glfw.ButtonRightBumper, 0}
+		return MultiplexRule{Button, glfw.ButtonRightBumper, 0}, nil
 	case "BUTTON_BACK":
-		return MultiplexRule{Button, glfw.ButtonBack, 0}
+		return MultiplexRule{Button, glfw.ButtonBack, 0}, nil
 	case "BUTTON_START":
-		return MultiplexRule{Button, glfw.ButtonStart, 0}
+		return MultiplexRule{Button, glfw.ButtonStart, 0}, nil
 	case "BUTTON_GUIDE":
-		return MultiplexRule{Button, glfw.ButtonGuide, 0}
+		return MultiplexRule{Button, glfw.ButtonGuide, 0}, nil
 	case "BUTTON_LEFT_THUMB":
-		return MultiplexRule{Button, glfw.ButtonLeftThumb, 0}
+		return MultiplexRule{Button, glfw.ButtonLeftThumb, 0}, nil
 	case "BUTTON_RIGHT_THUMB":
-		return MultiplexRule{Button, glfw.ButtonRightThumb, 0}
+		return MultiplexRule{Button, glfw.ButtonRightThumb, 0}, nil
 	case "BUTTON_DPAD_UP":
-		return MultiplexRule{Button, glfw.ButtonDpadUp, 0}
+		return MultiplexRule{Button, glfw.ButtonDpadUp, 0}, nil
 	case "BUTTON_DPAD_RIGHT":
-		return MultiplexRule{Button, glfw.ButtonDpadRight, 0}
+		return MultiplexRule{Button, glfw.ButtonDpadRight, 0}, nil
 	case "BUTTON_DPAD_DOWN":
-		return MultiplexRule{Button, glfw.ButtonDpadDown, 0}
+		return MultiplexRule{Button, glfw.ButtonDpadDown, 0}, nil
 	case "BUTTON_DPAD_LEFT":
-		return MultiplexRule{Button, glfw.ButtonDpadLeft, 0}
+		return MultiplexRule{Button, glfw.ButtonDpadLeft, 0}, nil
 	case "AXIS_LEFT_X":
-		return MultiplexRule{Axis, 0, glfw.AxisLeftX}
+		return MultiplexRule{Axis, 0, glfw.AxisLeftX}, nil
 	case "AXIS_LEFT_Y":
-		return MultiplexRule{Axis, 0, glfw.AxisLeftY}
+		return MultiplexRule{Axis, 0, glfw.AxisLeftY}, nil
 	case "AXIS_RIGHT_X":
-		return MultiplexRule{Axis, 0, glfw.AxisRightX}
+		return MultiplexRule{Axis, 0, glfw.AxisRightX}, nil
 	case "AXIS_RIGHT_Y":
-		return MultiplexRule{Axis, 0, glfw.AxisRightY}
+		return MultiplexRule{Axis, 0, glfw.AxisRightY}, nil
 	case "AXIS_LEFT_TRIGGER":
-		return MultiplexRule{Axis, 0, glfw.AxisLeftTrigger}
+		return MultiplexRule{Axis, 0, glfw.AxisLeftTrigger}, nil
 	case "AXIS_RIGHT_TRIGGER":
-		return MultiplexRule{Axis, 0, glfw.AxisRightTrigger}
+		return MultiplexRule{Axis, 0, glfw.AxisRightTrigger}, nil
 	}
 
-	log.Fatalf("CONFIG ERROR: Unrecognized BUTTON or AXIS %s!\n", rule)
-	return MultiplexRule{}
+	return MultiplexRule{}, fmt.Errorf("Unrecognized BUTTON or AXIS %s", rule)
 }
 
-func readConfig(filename string) (clientRules ClientsMap, buttonMap ButtonMap, axisMap AxisMap) {
-	yamlFile, err := ioutil.ReadFile(filename)
+// ruleNames is the name of every button and axis, the way the config spells them
+var ruleNames = func() map[MultiplexRule]string {
+	names := make(map[MultiplexRule]string)
+	for _, name := range []string{
+		"BUTTON_A", "BUTTON_B", "BUTTON_X", "BUTTON_Y",
+		"BUTTON_LEFT_BUMPER", "BUTTON_RIGHT_BUMPER", "BUTTON_BACK", "BUTTON_START",
+		"BUTTON_GUIDE", "BUTTON_LEFT_THUMB", "BUTTON_RIGHT_THUMB",
+		"BUTTON_DPAD_UP", "BUTTON_DPAD_RIGHT", "BUTTON_DPAD_DOWN", "BUTTON_DPAD_LEFT",
+		"AXIS_LEFT_X", "AXIS_LEFT_Y", "AXIS_RIGHT_X", "AXIS_RIGHT_Y",
+		"AXIS_LEFT_TRIGGER", "AXIS_RIGHT_TRIGGER",
+	} {
+		rule, _ := parseRule(name)
+		names[rule] = name
+	}
+	return names
+}()
+
+// parseSelectorMap parses the joysticks and rules of a client
+func parseSelectorMap(joysticks map[string][]string) (SelectorMap, error) {
+	rules := make(SelectorMap)
+	for name, names := range joysticks {
+		selector, err := parseSelector(name)
+		if err != nil {
+			return nil, err
+		}
+		if _, exists := rules[selector]; exists {
+			return nil, fmt.Errorf("%s already defined", selector)
+		}
 
+		rules[selector] = make([]MultiplexRule, len(names))
+		for i, name := range names {
+			rules[selector][i], err = parseRule(name)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return rules, nil
+}
+
+// ruleNamesOf turns a client's rules back into the names the config uses
+func ruleNamesOf(rules SelectorMap) map[string][]string {
+	joysticks := make(map[string][]string)
+	for selector, array := range rules {
+		names := make([]string, len(array))
+		for i, rule := range array {
+			names[i] = ruleNames[rule]
+		}
+		joysticks[selector.String()] = names
+	}
+	return joysticks
+}
+
+// ServerConfig is everything the server takes from the config file
+type ServerConfig struct {
+	Rules    ClientsMap
+	Profiles map[string]Profile
+	// Profile the server starts with
+	Profile string
+	// Buttons that move on to the next profile when one joystick holds them all
+	ProfileChord []glfw.GamepadButton
+}
+
+// loadConfig reads and checks the whole config, nothing is used unless all of
+// it is valid. Every problem found is returned together as ConfigErrors
+func loadConfig(filename string) (ServerConfig, error) {
+	yamlFile, err := ioutil.ReadFile(filename)
 	if err != nil {
-		// TODO Don't panic
-		panic(err)
+		return ServerConfig{}, err
 	}
 
-	var config Config
-	err = yaml.Unmarshal(yamlFile, &config)
+	// The nodes know which line everything is on
+	var root yaml.Node
+	err = yaml.Unmarshal(yamlFile, &root)
 	if err != nil {
-		log.Fatalln("CONFIG ERROR: Failed to read config file due to error:", err)
+		return ServerConfig{}, ConfigErrors{yamlError(err.Error())}
 	}
+	parser := &configParser{root: &root}
 
-	// Parse client rules
-	// id -> controller -> [rules]
-	clientRules = make(ClientsMap)
-	for id, joysticks := range config.Clients {
-		if _, exists := clientRules[id]; exists {
-			log.Fatalf("CONFIG ERROR: client %s already defined.", id)
+	// Values of the wrong type and misspelled settings don't stop the rest
+	// of the config from being read and checked
+	var config Config
+	decoder := yaml.NewDecoder(bytes.NewReader(yamlFile))
+	decoder.KnownFields(true)
+	err = decoder.Decode(&config)
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		for _, message := range typeErr.Errors {
+			parser.errs = append(parser.errs, yamlError(message))
 		}
+	} else if err != nil && err != io.EOF {
+		return ServerConfig{}, ConfigErrors{yamlError(err.Error())}
+	}
 
-		clientRules[id] = make(map[glfw.Joystick][]MultiplexRule)
-		for joystick, rules := range joysticks {
-			joystick := glfw.Joystick(joystick[len(joystick)-1] - '0')
+	clientRules := parser.parseClients([]interface{}{"clients"}, config.Clients)
 
-			if _, exists := clientRules[id][joystick]; exists {
-				log.Fatalf("CONFIG ERROR: client %s joystick %d already defined.", id, joystick)
-			}
+	// The sections outside of profiles make up the default profile, and
+	// fill in whatever the other profiles leave out
+	buttonMap, axisMap := parser.parseMapping([]interface{}{"mapping"}, config.Mapping)
+	mouse := parser.parseMouse([]interface{}{"mouse"}, defaultMouse, config.Mouse)
+	parser.checkMultiplexer([]interface{}{"multiplexer"}, config.Multiplexer)
+	responses := parser.parseAxes([]interface{}{"axes"}, config.Axes, clientRules, nil)
+	profiles := map[string]Profile{
+		DEFAULT_PROFILE: {DEFAULT_PROFILE, Mapping{buttonMap, axisMap, mouse}, config.Multiplexer, responses},
+	}
 
-			clientRules[id][joystick] = make([]MultiplexRule, len(rules))
-			for i, rule := range rules {
-				clientRules[id][joystick][i] = stringToRule(rule)
-			}
+	for name, profileConfig := range config.Profiles {
+		path := []interface{}{"profiles", name}
+		profile := profiles[DEFAULT_PROFILE]
+		profile.Name = name
+		if profileConfig.Mapping != nil {
+			profile.Mapping.Buttons, profile.Mapping.Axes = parser.parseMapping(at(path, "mapping"), profileConfig.Mapping)
+		}
+		if profileConfig.Mouse != nil {
+			profile.Mapping.Mouse = parser.parseMouse(at(path, "mouse"), mouse, *profileConfig.Mouse)
+		}
+		if profileConfig.Multiplexer != nil {
+			profile.Multiplexer = *profileConfig.Multiplexer
+			parser.checkMultiplexer(at(path, "multiplexer"), profile.Multiplexer)
 		}
+		if profileConfig.Axes != nil {
+			profile.Responses = parser.parseAxes(at(path, "axes"), profileConfig.Axes, clientRules, responses)
+		}
+		profiles[name] = profile
 	}
 
-	buttonMap = make(map[glfw.GamepadButton]MapRule)
-	axisMap = make(map[glfw.GamepadAxis]MapRule)
-
-	// Parse mapping "input gamestate -> output keypress"
-	for input, key := range config.Mapping {
-		rule := stringToRule(input)
-
-		if rule.Type == Axis {
-			if rule.Axis == glfw.AxisLeftTrigger || rule.Axis == glfw.AxisRightTrigger {
-				// Triggers map to a single key
-				axisMap[rule.Axis] = MapRule{key, ""}
-			} else {
-				// Joysticks left and right axes require 2 keys to properly handle
-				// The first key is for negative axis values, second key is positive values
-				keys := strings.Fields(key)
-				if len(keys) != 2 {
-					log.Fatalf("CONFIG ERROR: rule %s requires 2 key outputs.\nFor example:\n%s: left right", input, input)
-				}
-
-				axisMap[rule.Axis] = MapRule{keys[0], keys[1]}
-			}
-		} else {
-			// Buttons and the
-			buttonMap[rule.Button] = MapRule{key, ""}
-		}
+	profile := config.Profile
+	if profile == "" {
+		profile = DEFAULT_PROFILE
+	}
+	if _, exists := profiles[profile]; !exists {
+		parser.fail([]interface{}{"profile"}, "no profile named %s", profile)
+	}
+	chord := parser.parseChord([]interface{}{"profile_chord"}, "profile chord", config.ProfileChord)
+
+	if len(parser.errs) > 0 {
+		errs := parser.errs
+		sort.SliceStable(errs, func(i, j int) bool { return errs[i].Line < errs[j].Line })
+		return ServerConfig{}, errs
 	}
 
-	return clientRules, buttonMap, axisMap
+	return ServerConfig{
+		Rules:        clientRules,
+		Profiles:     profiles,
+		Profile:      profile,
+		ProfileChord: chord,
+	}, nil
 }
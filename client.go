@@ -5,72 +5,241 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"time"
+
+	"github.com/go-gl/glfw/v3.3/glfw"
+)
+
+// How often clients look at their joysticks, fast enough to send button
+// presses as they happen
+const POLL_INTERVAL time.Duration = 4 * time.Millisecond
+
+// Axes have to move further than this for the change to be sent
+const AXIS_NOISE float32 = 0.01
+
+// How long to wait before trying to reconnect, doubling after every failure
+const (
+	RECONNECT_MIN_BACKOFF time.Duration = 250 * time.Millisecond
+	RECONNECT_MAX_BACKOFF time.Duration = 10 * time.Second
 )
 
-func connect(host string, port uint16, name string) (conn *ClientConn) {
+// How long to wait for the server to pick up before giving up on an attempt
+const DIAL_TIMEOUT time.Duration = 5 * time.Second
+
+func connect(host string, port uint16, name string, security Security) (conn *ClientConn) {
 	conn = &ClientConn{
+		Host:         host,
+		Port:         port,
 		Name:         name,
+		Security:     security,
 		ControlConn:  nil,
 		DatagramConn: nil,
 		Rules:        RulesMap{},
+		Rumbles:      make(chan RumbleCommand, 16),
+		peripherals:  make(map[uint8]Peripheral),
 	}
-	tcpRaddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%d", host, port))
+
+	// Nothing to fall back on the first time around
+	err := conn.dial()
 	if err != nil {
-		log.Fatalln("Failed to resolve addr with err:", err)
+		log.Fatalln("Failed to connect due to error:", err)
+	}
+	conn.connected = true
+
+	return conn
+}
+
+// dial connects the control socket, does the handshake and spins off the
+// UDP connection the gamestate packets go over
+func (c *ClientConn) dial() error {
+	tcpRaddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%d", c.Host, c.Port))
+	if err != nil {
+		return err
 	}
 
 	// Connect to the server
-	conn.ControlConn, err = net.DialTCP("tcp", nil, tcpRaddr)
+	tcpConn, err := net.DialTimeout("tcp", tcpRaddr.String(), DIAL_TIMEOUT)
 	if err != nil {
-		log.Fatalln("Failed to connect with err:", err)
+		return err
 	}
+	c.ControlConn = NewControlStream(tcpConn)
+	c.datagramCipher = nil
+	// A new session has none of the old keyframes
+	c.encoders = make(map[uint8]*DeltaEncoder)
 
 	// Do the handshake to get the id and config
-	err = conn.Handshake()
+	err = c.Handshake()
 	if err != nil {
-		log.Fatalln("Handshake failed due to error:", err)
+		c.ControlConn.Close()
+		return fmt.Errorf("handshake failed: %w", err)
 	}
 
 	// Spin off a UDP connection to the same socket
-	udpRaddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", host, port))
+	udpRaddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", c.Host, c.Port))
 	if err != nil {
-		log.Fatalln("Failed to resolve addr with err:", err)
+		c.ControlConn.Close()
+		return err
 	}
 
 	// Connect to the server
-	conn.DatagramConn, err = net.DialUDP("udp", nil, udpRaddr)
+	c.DatagramConn, err = net.DialUDP("udp", nil, udpRaddr)
 	if err != nil {
-		log.Fatalln("Failed to connect with err:", err)
+		c.ControlConn.Close()
+		return err
 	}
 
-	return conn
+	// Keep pinging the server until this connection closes
+	if c.Version >= HEARTBEAT_PROTOCOL_VERSION {
+		go c.Link.Ping(c.ControlConn)
+	}
+
+	return nil
+}
+
+// reconnect keeps trying to get back into the session, waiting longer after
+// every attempt that fails. Gamestate packets are dropped until it's done,
+// and the lock is only held while dialing so the joysticks keep being polled
+func (c *ClientConn) reconnect() {
+	c.lock.Lock()
+	c.connected = false
+	c.ControlConn.Close()
+	c.DatagramConn.Close()
+	c.lock.Unlock()
+
+	backoff := RECONNECT_MIN_BACKOFF
+	for {
+		time.Sleep(backoff)
+
+		c.lock.Lock()
+		err := c.dial()
+		c.connected = err == nil
+		c.lock.Unlock()
+		if err == nil {
+			log.Printf("Reconnected to the server as id %d\n", c.Id)
+			return
+		}
+
+		backoff *= 2
+		if backoff > RECONNECT_MAX_BACKOFF {
+			backoff = RECONNECT_MAX_BACKOFF
+		}
+		log.Printf("Failed to reconnect due to error: %s, trying again in %s\n", err, backoff)
+	}
+}
+
+// GamestateSender decides when the state of a joystick is worth sending.
+// Button presses go out right away, moving axes at most once a tick and a
+// joystick nobody touches once every keepalive so the server knows it's there
+type GamestateSender struct {
+	Tick      time.Duration
+	Keepalive time.Duration
+
+	last glfw.GamepadState
+	sent time.Time
+}
+
+// ShouldSend checks if state has to be sent now, and remembers it if so
+func (s *GamestateSender) ShouldSend(state glfw.GamepadState, now time.Time) bool {
+	elapsed := now.Sub(s.sent)
+
+	var send bool
+	if s.sent.IsZero() || state.Buttons != s.last.Buttons {
+		send = true
+	} else if axesMoved(state, s.last) {
+		send = elapsed >= s.Tick
+	} else {
+		send = elapsed >= s.Keepalive
+	}
+
+	if send {
+		s.last = state
+		s.sent = now
+	}
+	return send
+}
+
+// Reset forgets what was sent so the next state goes out right away
+func (s *GamestateSender) Reset() {
+	s.sent = time.Time{}
+}
+
+// axesMoved checks if any axis moved by more than noise
+func axesMoved(state, last glfw.GamepadState) bool {
+	for axis := range state.Axes {
+		if abs32(state.Axes[axis]-last.Axes[axis]) > AXIS_NOISE {
+			return true
+		}
+	}
+	return false
+}
+
+// playRumble plays a rumble from the server on the joystick it's meant for,
+// or on every joystick that's plugged in
+func playRumble(haptics Haptics, joysticks [16]glfw.Joystick, cmd RumbleCommand) {
+	for i, joy := range joysticks {
+		if cmd.Joystick != ALL_JOYSTICKS && cmd.Joystick != uint8(i) {
+			continue
+		}
+		if !joy.Present() {
+			continue
+		}
+
+		err := haptics.Rumble(joy, cmd.Effect)
+		if err != nil {
+			log.Printf("Failed to rumble joystick %d due to error: %s\n", i, err)
+		}
+	}
 }
 
 func (c *ClientConn) Handshake() error {
 	pkt := &ControlProtocol{}
 
-	// Register a name
-	_, err := c.ControlConn.Write(pkt.Register(c.Name))
-	if err != nil {
-		return err
+	// Register a name, or pick the old session back up if we had one
+	var err error
+	if c.ResumeToken != (SessionToken{}) {
+		err = c.ControlConn.Write(pkt.Resume(PROTOCOL_VERSION, CAPABILITIES, c.ResumeToken, c.Name))
+	} else {
+		err = c.ControlConn.Write(pkt.Register(PROTOCOL_VERSION, CAPABILITIES, c.Name))
 	}
-
-	// Read in the next packet
-	buf := make([]byte, 512)
-	_, err = c.ControlConn.Read(buf)
 	if err != nil {
 		return err
 	}
 
-	// See if it's an ID
-	err = pkt.Parse(buf)
+	// Read in the next packet and see if it's an ID
+	pkt, err = c.ControlConn.ReadPacket()
 	if err != nil {
 		return err
 	}
 
 	if pkt.Type == SET_ID {
-		// Get the id
-		c.Id = pkt.Data[0]
+		// Get the id and what the server agreed to
+		var version uint8
+		var capabilities uint32
+		c.Id, version, capabilities, c.Token, err = pkt.ParseSetId()
+		if err != nil {
+			c.ControlConn.Close()
+			return err
+		}
+
+		// The server may only talk down to us, and only about things we support
+		c.Version, c.Capabilities, err = negotiate(version, capabilities)
+		c.negotiation = Negotiation{PROTOCOL_VERSION, CAPABILITIES, version, capabilities}
+		if err == nil && c.Security.Required && c.Capabilities&CAP_ENCRYPTION == 0 {
+			err = errors.New("server refused to encrypt the connection")
+		}
+		if err != nil {
+			c.ControlConn.Close()
+			return err
+		}
+
+		// Everything after the id is encrypted when both sides can
+		if c.Capabilities&CAP_ENCRYPTION != 0 {
+			err = c.exchangeKeys()
+			if err != nil {
+				c.ControlConn.Close()
+				return err
+			}
+		}
 	} else if pkt.Type == ERROR {
 		// Close the connection since this is wonky
 		c.ControlConn.Close()
@@ -81,15 +250,8 @@ func (c *ClientConn) Handshake() error {
 		return errors.New("server response was invalid, aborting connection")
 	}
 
-	// Get the next packet
-	buf = make([]byte, 4096)
-	_, err = c.ControlConn.Read(buf)
-	if err != nil {
-		return err
-	}
-
-	// See if it's a configuration
-	err = pkt.Parse(buf)
+	// Get the next packet and see if it's a configuration
+	pkt, err = c.ControlConn.ReadPacket()
 	if err != nil {
 		return err
 	}
@@ -109,6 +271,183 @@ func (c *ClientConn) Handshake() error {
 		return errors.New("server response was invalid, aborting connection")
 	}
 
+	// Newer servers hand out a token to resume the session with
+	c.ResumeToken = SessionToken{}
+	if c.Version >= RESUME_PROTOCOL_VERSION {
+		pkt, err = c.ControlConn.ReadPacket()
+		if err != nil {
+			return err
+		}
+
+		c.ResumeToken, err = pkt.ParseResumeToken()
+		if err != nil {
+			c.ControlConn.Close()
+			return err
+		}
+	}
+
+	// A new session doesn't know what's plugged in yet
+	if c.Version >= PERIPHERAL_PROTOCOL_VERSION {
+		for _, peripheral := range c.peripherals {
+			err = c.ControlConn.Write(pkt.PeripheralConnect(peripheral))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
 	// Handshake is complete
 	return nil
 }
+
+// SetPeripheral tells the server which controller is plugged in as a
+// joystick, or nil when nothing is, so rules can follow controllers around.
+// Only changes get sent
+func (c *ClientConn) SetPeripheral(joystick uint8, peripheral *Peripheral) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	known, exists := c.peripherals[joystick]
+	pkt := &ControlProtocol{}
+	if peripheral == nil {
+		if !exists {
+			return
+		}
+		delete(c.peripherals, joystick)
+		if c.connected && c.Version >= PERIPHERAL_PROTOCOL_VERSION {
+			c.ControlConn.Write(pkt.PeripheralDisconnect(joystick))
+		}
+		return
+	}
+
+	if exists && known == *peripheral {
+		return
+	}
+	c.peripherals[joystick] = *peripheral
+	if c.connected && c.Version >= PERIPHERAL_PROTOCOL_VERSION {
+		c.ControlConn.Write(pkt.PeripheralConnect(*peripheral))
+	}
+}
+
+// exchangeKeys runs the client's side of the X25519 key exchange and
+// encrypts the control socket and gamestate packets with the result
+func (c *ClientConn) exchangeKeys() error {
+	keys, err := newKeyPair()
+	if err != nil {
+		return err
+	}
+
+	// Send our half first
+	pkt := &ControlProtocol{}
+	err = c.ControlConn.Write(pkt.KeyExchange(keys.Public))
+	if err != nil {
+		return err
+	}
+
+	pkt, err = c.ControlConn.ReadPacket()
+	if err != nil {
+		return err
+	}
+	if pkt.Type == ERROR {
+		return errors.New(string(pkt.Data))
+	} else if pkt.Type != KEY_EXCHANGE {
+		return errors.New("server response was invalid, aborting connection")
+	}
+
+	session, err := deriveKeys(keys, pkt.Data, keys.Public, pkt.Data, c.Token, c.Security.Secret, c.negotiation)
+	if err != nil {
+		return err
+	}
+
+	c.ControlConn.Encrypt(session.ClientControl, session.ServerControl)
+	c.datagramCipher = session.ClientDatagram
+	return nil
+}
+
+// SendGamestate stamps a gamestate packet with the next packet id and the
+// session's id and token and sends it to the server, sealing it if the
+// connection is encrypted. Joysticks the server gave no rules to are skipped
+func (c *ClientConn) SendGamestate(pkt GamestateProtocol) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.connected || c.Rules[glfw.Joystick(pkt.DeviceId)] == nil {
+		return nil
+	}
+	// Packet ids only count packets that were sent so the server can spot the lost ones
+	c.packetId++
+	pkt.PacketId = c.packetId
+	pkt.ClientId = c.Id
+	pkt.Token = c.Token
+
+	// Only send what changed when the server can put it back together
+	if c.Capabilities&CAP_COMPRESSION != 0 {
+		encoder, exists := c.encoders[pkt.DeviceId]
+		if !exists {
+			encoder = &DeltaEncoder{}
+			c.encoders[pkt.DeviceId] = encoder
+		}
+		pkt.Compressed = true
+		encoder.Encode(&pkt, time.Now())
+	}
+
+	data := pkt.Bytes()
+	if c.datagramCipher != nil {
+		data = pkt.Seal(c.datagramCipher)
+	}
+	_, err := c.DatagramConn.Write(data)
+	return err
+}
+
+// ControlListener handles the messages the server sends after the handshake
+func (c *ClientConn) ControlListener() {
+	for {
+		// A server that stopped answering pings is gone
+		if c.Version >= HEARTBEAT_PROTOCOL_VERSION {
+			c.ControlConn.SetReadDeadline(time.Now().Add(HEARTBEAT_TIMEOUT))
+		}
+		pkt, err := c.ControlConn.ReadPacket()
+		if err != nil {
+			log.Println("Lost the control connection due to error:", err)
+			c.reconnect()
+			continue
+		}
+
+		switch pkt.Type {
+		case PING:
+			c.ControlConn.Write(pkt.Pong(pkt))
+		case PONG:
+			c.Link.Pong(pkt)
+		case CONFIGURATION:
+			rules, err := ParseRulesMap(pkt.Data)
+			if err != nil {
+				log.Println("Server sent a bad configuration:", err)
+				continue
+			}
+			c.lock.Lock()
+			c.Rules = rules
+			c.lock.Unlock()
+			log.Println("The server changed your rules")
+		case DONE:
+			// Reconnecting would only get us kicked again
+			log.Fatalln("The server ended the session:", string(pkt.Data))
+		case RUMBLE:
+			joystick, effect, err := pkt.ParseRumble()
+			if err != nil {
+				log.Println("Server sent a bad rumble:", err)
+				continue
+			}
+			// Stale rumble isn't worth waiting for
+			select {
+			case c.Rumbles <- RumbleCommand{joystick, effect}:
+			default:
+			}
+		case TURN_START:
+			log.Println("Your turn has started!")
+		case TURN_END:
+			log.Println("Your turn is over")
+		case ERROR:
+			log.Println("Server error:", string(pkt.Data))
+		}
+	}
+}
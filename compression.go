@@ -0,0 +1,129 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/go-gl/glfw/v3.3/glfw"
+)
+
+// How often a compressed joystick sends its whole state. Deltas only build on
+// the latest keyframe, so a lost keyframe leaves the axes a delta doesn't
+// carry stale for this long. Buttons are in every delta so presses get through
+const KEYFRAME_INTERVAL time.Duration = 500 * time.Millisecond
+
+// Bits of the changed mask in a delta, axis n changed is DELTA_AXES << n.
+// A set DELTA_KEYFRAME means the packet holds the whole state instead
+const (
+	DELTA_BUTTONS  uint8 = 1 << 0
+	DELTA_AXES     uint8 = 1 << 1
+	DELTA_KEYFRAME uint8 = 1 << 7
+)
+
+// Every field changed, a keyframe is no bigger than a delta
+const deltaAll = DELTA_BUTTONS | DELTA_AXES*(1<<6-1)
+
+// quantize squeezes an axis into an int16
+func quantize(value float32) int16 {
+	return int16(math.Round(float64(clamp32(value, -1, 1) * math.MaxInt16)))
+}
+
+func dequantize(value int16) float32 {
+	return clamp32(float32(value)/math.MaxInt16, -1, 1)
+}
+
+// quantized rounds every axis of a state the way it goes over the wire
+func quantized(state glfw.GamepadState) glfw.GamepadState {
+	for axis := range state.Axes {
+		state.Axes[axis] = dequantize(quantize(state.Axes[axis]))
+	}
+	return state
+}
+
+// DeltaEncoder decides what goes into the compressed packets of one joystick
+type DeltaEncoder struct {
+	keyframeId   uint32
+	keyframe     glfw.GamepadState
+	keyframeSent time.Time
+	hasKeyframe  bool
+}
+
+// Encode fills in what changed since the last keyframe, or turns the packet
+// into a new keyframe when one is due. The packet id has to be set already
+func (e *DeltaEncoder) Encode(pkt *GamestateProtocol, now time.Time) {
+	state := quantized(pkt.GamepadState)
+
+	// Buttons are cheap and every edge matters, so they always go along
+	changed := DELTA_BUTTONS
+	for axis := range state.Axes {
+		if state.Axes[axis] != e.keyframe.Axes[axis] {
+			changed |= DELTA_AXES << axis
+		}
+	}
+
+	if !e.hasKeyframe || changed == deltaAll || now.Sub(e.keyframeSent) >= KEYFRAME_INTERVAL {
+		pkt.Changed = DELTA_KEYFRAME
+		e.keyframeId = pkt.PacketId
+		e.keyframe = state
+		e.keyframeSent = now
+		e.hasKeyframe = true
+		return
+	}
+
+	pkt.Changed = changed
+	pkt.Base = e.keyframeId
+}
+
+// DeltaDecoder rebuilds the states of one client's joysticks from their
+// compressed packets
+type DeltaDecoder struct {
+	keyframes map[uint8]Keyframe
+	// The last state put back together for each joystick
+	latest map[uint8]glfw.GamepadState
+}
+
+// Keyframe is the latest whole state of a joystick
+type Keyframe struct {
+	Id    uint32
+	State glfw.GamepadState
+}
+
+// Decode fills in the fields a delta left out from the keyframe it builds on.
+// When that keyframe got lost the buttons a delta carries are still used so
+// no press is missed, and the axes it left out stay where they last were
+// until the next keyframe. Deltas without buttons need their keyframe
+func (d *DeltaDecoder) Decode(pkt *GamestateProtocol) bool {
+	if d.keyframes == nil {
+		d.keyframes = make(map[uint8]Keyframe)
+		d.latest = make(map[uint8]glfw.GamepadState)
+	}
+
+	if pkt.Changed&DELTA_KEYFRAME != 0 {
+		d.keyframes[pkt.DeviceId] = Keyframe{pkt.PacketId, pkt.GamepadState}
+		d.latest[pkt.DeviceId] = pkt.GamepadState
+		return true
+	}
+
+	base, exists := d.keyframes[pkt.DeviceId]
+	if !exists || base.Id != pkt.Base {
+		if pkt.Changed&DELTA_BUTTONS == 0 {
+			return false
+		}
+		latest, exists := d.latest[pkt.DeviceId]
+		if !exists {
+			latest = resting
+		}
+		base = Keyframe{pkt.Base, latest}
+	}
+
+	if pkt.Changed&DELTA_BUTTONS == 0 {
+		pkt.GamepadState.Buttons = base.State.Buttons
+	}
+	for axis := range pkt.GamepadState.Axes {
+		if pkt.Changed&(DELTA_AXES<<axis) == 0 {
+			pkt.GamepadState.Axes[axis] = base.State.Axes[axis]
+		}
+	}
+	d.latest[pkt.DeviceId] = pkt.GamepadState
+	return true
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-gl/glfw/v3.3/glfw"
+)
+
+func TestDeltaRoundTrip(t *testing.T) {
+	lx, ly, rt := glfw.AxisLeftX, glfw.AxisLeftY, glfw.AxisRightTrigger
+	start := time.Now()
+
+	// What one joystick sends, packet n has id n+1
+	sent := []struct {
+		at       time.Duration
+		state    glfw.GamepadState
+		keyframe bool
+	}{
+		{0, resting, true},
+		{10 * time.Millisecond, with(gamepad(glfw.ButtonA), lx, 0.5), false},
+		{20 * time.Millisecond, with(with(resting, lx, 0.5), ly, -0.25), false},
+		{600 * time.Millisecond, with(with(with(resting, lx, 0.5), ly, -0.25), rt, 1), true},
+		{610 * time.Millisecond, with(with(with(gamepad(glfw.ButtonB), lx, 0.75), ly, -0.25), rt, 1), false},
+		{620 * time.Millisecond, with(with(with(resting, lx, 0.75), ly, -0.25), rt, 1), false},
+		{1200 * time.Millisecond, with(resting, lx, 0.1), true},
+		{1210 * time.Millisecond, with(gamepad(glfw.ButtonX), lx, 0.1), false},
+	}
+	var encoder DeltaEncoder
+	packets := make([][]byte, len(sent))
+	for i, s := range sent {
+		pkt := GamestateProtocol{PacketId: uint32(i + 1), ClientId: 3, DeviceId: 2, GamepadState: s.state, Compressed: true}
+		encoder.Encode(&pkt, start.Add(s.at))
+		if keyframe := pkt.Changed&DELTA_KEYFRAME != 0; keyframe != s.keyframe {
+			t.Fatalf("packet %d keyframe %v, want %v", i+1, keyframe, s.keyframe)
+		}
+		packets[i] = pkt.Bytes()
+	}
+
+	// While the keyframe the deltas build on is missing, the right trigger
+	// they leave out stays where the last packet that arrived put it
+	stale := with(with(with(resting, lx, 0.75), ly, -0.25), rt, -1)
+	stalePressing := func(buttons ...glfw.GamepadButton) glfw.GamepadState {
+		state := gamepad(buttons...)
+		state.Axes = stale.Axes
+		return state
+	}
+
+	tests := []struct {
+		name string
+		// Packets by id in the order they arrive
+		arrive []uint32
+		// Packets that come after a newer one and get dropped
+		late map[uint32]bool
+		// What packets decode into when it isn't what was sent
+		want map[uint32]glfw.GamepadState
+	}{
+		{"everything arrives", []uint32{1, 2, 3, 4, 5, 6, 7, 8}, nil, nil},
+		{"delta dropped", []uint32{1, 3, 4, 6, 7, 8}, nil, nil},
+		{"first keyframe dropped", []uint32{2, 3, 4, 5, 6, 7, 8}, nil, nil},
+		{"keyframe dropped", []uint32{1, 2, 3, 5, 6, 7, 8}, nil, map[uint32]glfw.GamepadState{
+			5: stalePressing(glfw.ButtonB),
+			6: stale,
+		}},
+		{"deltas reordered", []uint32{1, 3, 2, 4, 6, 5, 7, 8}, map[uint32]bool{2: true, 5: true}, nil},
+		{"keyframe arrives late", []uint32{1, 2, 3, 5, 4, 6, 8, 7}, map[uint32]bool{4: true, 7: true}, map[uint32]glfw.GamepadState{
+			5: stalePressing(glfw.ButtonB),
+			6: stale,
+			// Nothing moved since keyframe 7, which hasn't arrived, so only the buttons get through
+			8: stalePressing(glfw.ButtonX),
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The server drops anything older than what it already has before decoding
+			server := &ServerConn{}
+			for _, id := range test.arrive {
+				pkt := &GamestateProtocol{Compressed: true}
+				if err := pkt.Parse(packets[id-1]); err != nil {
+					t.Fatalf("packet %d failed to parse with %s", id, err)
+				}
+				if !server.fresh(pkt) {
+					if !test.late[id] {
+						t.Fatalf("packet %d was dropped", id)
+					}
+					continue
+				}
+				if test.late[id] {
+					t.Fatalf("packet %d came late but was used", id)
+				}
+
+				if !server.deltas.Decode(pkt) {
+					t.Fatalf("packet %d failed to decode", id)
+				}
+				want, exists := test.want[id]
+				if !exists {
+					want = sent[id-1].state
+				}
+				if !sameGamepad(pkt.GamepadState, quantized(want)) {
+					t.Fatalf("packet %d decoded into %v, want %v", id, pkt.GamepadState, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDeltaWithoutKeyframe(t *testing.T) {
+	var decoder DeltaDecoder
+	// A delta that carries no buttons can't be trusted without its keyframe
+	pkt := &GamestateProtocol{PacketId: 2, DeviceId: 1, Changed: DELTA_AXES << glfw.AxisLeftX, Base: 1}
+	pkt.GamepadState = with(resting, glfw.AxisLeftX, 0.5)
+	if decoder.Decode(pkt) {
+		t.Fatal("decoded a delta without buttons or its keyframe")
+	}
+
+	// Joysticks keep their own keyframes
+	keyframe := &GamestateProtocol{PacketId: 3, DeviceId: 0, Changed: DELTA_KEYFRAME, GamepadState: gamepad(glfw.ButtonA)}
+	decoder.Decode(keyframe)
+	pkt.PacketId, pkt.Base = 4, 3
+	if decoder.Decode(pkt) {
+		t.Fatal("decoded a delta on the keyframe of another joystick")
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/go-gl/glfw/v3.3/glfw"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigError is one problem with the config and the line it's on, Line is
+// 0 when it isn't on any line in particular
+type ConfigError struct {
+	Line    int
+	Message string
+}
+
+func (e ConfigError) Error() string {
+	if e.Line == 0 {
+		return e.Message
+	}
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+// ConfigErrors is everything wrong with a config, in the order it's written
+type ConfigErrors []ConfigError
+
+func (e ConfigErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// logConfigError logs every problem with a config on its own line
+func logConfigError(err error) {
+	if errs, ok := err.(ConfigErrors); ok {
+		for _, err := range errs {
+			log.Println("CONFIG ERROR:", err)
+		}
+		return
+	}
+	log.Println("CONFIG ERROR:", err)
+}
+
+// yamlError pulls the line out of an error from the yaml package, they look
+// like "yaml: line 3: did not find expected key"
+func yamlError(message string) ConfigError {
+	message = strings.TrimPrefix(message, "yaml: ")
+	var line int
+	if _, err := fmt.Sscanf(message, "line %d:", &line); err == nil {
+		message = strings.TrimSpace(message[strings.Index(message, ":")+1:])
+	}
+	return ConfigError{line, message}
+}
+
+// lineOf finds the line of something in the config by the keys and list
+// indexes leading to it, or 0 if it's not there. Keys give the line of the
+// key itself so the line is right even when its value starts below it
+func lineOf(node *yaml.Node, path ...interface{}) int {
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+
+	line := node.Line
+	for _, step := range path {
+		switch step := step.(type) {
+		case string:
+			var value *yaml.Node
+			for i := 0; node.Kind == yaml.MappingNode && i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == step {
+					line = node.Content[i].Line
+					value = node.Content[i+1]
+				}
+			}
+			if value == nil {
+				return 0
+			}
+			node = value
+		case int:
+			if node.Kind != yaml.SequenceNode || step >= len(node.Content) {
+				return 0
+			}
+			node = node.Content[step]
+			line = node.Line
+		}
+	}
+	return line
+}
+
+// configParser checks the config section by section, collecting every
+// problem along with its line instead of stopping at the first one
+type configParser struct {
+	root *yaml.Node
+	errs ConfigErrors
+}
+
+// fail records a problem with whatever the keys and list indexes lead to
+func (p *configParser) fail(path []interface{}, format string, args ...interface{}) {
+	p.errs = append(p.errs, ConfigError{lineOf(p.root, path...), fmt.Sprintf(format, args...)})
+}
+
+// at adds steps to a path without touching the path it was given
+func at(path []interface{}, steps ...interface{}) []interface{} {
+	return append(append([]interface{}{}, path...), steps...)
+}
+
+// parseClients parses the joysticks and rules of every client
+// id -> controller -> [rules]
+func (p *configParser) parseClients(path []interface{}, clients map[string]map[string][]string) ClientsMap {
+	clientRules := make(ClientsMap)
+	for id, joysticks := range clients {
+		clientRules[id] = make(SelectorMap)
+		for name, rules := range joysticks {
+			selector, err := parseSelector(name)
+			if err != nil {
+				p.fail(at(path, id, name), "client %s: %s", id, err)
+				continue
+			}
+			if _, exists := clientRules[id][selector]; exists {
+				p.fail(at(path, id, name), "client %s: %s already defined", id, selector)
+				continue
+			}
+
+			clientRules[id][selector] = make([]MultiplexRule, 0, len(rules))
+			for i, rule := range rules {
+				parsed, err := parseRule(rule)
+				if err != nil {
+					p.fail(at(path, id, name, i), "client %s: %s", id, err)
+					continue
+				}
+				clientRules[id][selector] = append(clientRules[id][selector], parsed)
+			}
+		}
+	}
+	return clientRules
+}
+
+// parseMapping parses the mapping "input gamestate -> output keypress"
+func (p *configParser) parseMapping(path []interface{}, mapping map[string]string) (ButtonMap, AxisMap) {
+	buttonMap := make(ButtonMap)
+	axisMap := make(AxisMap)
+
+	for input, key := range mapping {
+		rule, err := parseRule(input)
+		if err != nil {
+			p.fail(at(path, input), "%s", err)
+			continue
+		}
+
+		if rule.Type == Axis && !isTrigger(rule.Axis) {
+			if key == MOUSE_X || key == MOUSE_Y {
+				// Joysticks can move the mouse instead
+				axisMap[rule.Axis] = MapRule{key, ""}
+				continue
+			}
+
+			// Joysticks left and right axes require 2 keys to properly handle
+			// The first key is for negative axis values, second key is positive values
+			keys := strings.Fields(key)
+			if len(keys) != 2 {
+				p.fail(at(path, input), "rule %s requires 2 key outputs, for example %s: left right", input, input)
+				continue
+			}
+			for _, key := range keys {
+				if !validKey(key) {
+					p.fail(at(path, input), "unknown key %s for %s", key, input)
+				}
+			}
+			axisMap[rule.Axis] = MapRule{keys[0], keys[1]}
+			continue
+		}
+
+		// Buttons and triggers map to a single key
+		if !validKey(key) {
+			p.fail(at(path, input), "unknown key %s for %s", key, input)
+		}
+		if rule.Type == Axis {
+			axisMap[rule.Axis] = MapRule{key, ""}
+		} else {
+			buttonMap[rule.Button] = MapRule{key, ""}
+		}
+	}
+	return buttonMap, axisMap
+}
+
+// parseMouse checks the mouse settings that were set and takes the ones that
+// were left out from base
+func (p *configParser) parseMouse(path []interface{}, base MouseConfig, options MouseOptions) MouseConfig {
+	mouse := base
+	if options.Sensitivity != nil {
+		mouse.Sensitivity = *options.Sensitivity
+		if mouse.Sensitivity < 0 {
+			p.fail(at(path, "sensitivity"), "mouse sensitivity must be positive")
+		}
+	}
+	if options.Acceleration != nil {
+		mouse.Acceleration = *options.Acceleration
+		if mouse.Acceleration <= 0 {
+			p.fail(at(path, "acceleration"), "mouse acceleration must be positive")
+		}
+	}
+	if options.Deadzone != nil {
+		mouse.Deadzone = *options.Deadzone
+		if mouse.Deadzone < 0 || mouse.Deadzone >= 1 {
+			p.fail(at(path, "deadzone"), "mouse deadzone must be between 0 and 1")
+		}
+	}
+	return mouse
+}
+
+// parseAxes parses how every client shapes their axes, settings that are left
+// out come from base
+// id -> axis -> response
+func (p *configParser) parseAxes(path []interface{}, axes map[string]map[string]AxisOptions, clients ClientsMap, base ClientResponses) ClientResponses {
+	responses := make(ClientResponses)
+	for id, responseMap := range base {
+		responses[id] = make(ResponseMap)
+		for axis, response := range responseMap {
+			responses[id][axis] = response
+		}
+	}
+
+	for id, clientAxes := range axes {
+		if _, exists := clients[id]; !exists {
+			p.fail(at(path, id), "axes are set for %s but there's no client named %s", id, id)
+			continue
+		}
+
+		if responses[id] == nil {
+			responses[id] = make(ResponseMap)
+		}
+		for input, options := range clientAxes {
+			rule, err := parseRule(input)
+			if err != nil || rule.Type != Axis {
+				p.fail(at(path, id, input), "client %s: only axes can be shaped, got %s", id, input)
+				continue
+			}
+			response, exists := responses[id][rule.Axis]
+			if !exists {
+				response = defaultResponse(rule.Axis)
+			}
+			responses[id][rule.Axis] = p.parseResponse(at(path, id, input), rule.Axis, response, options)
+		}
+	}
+	return responses
+}
+
+// parseResponse checks the settings of an axis that were set and takes the
+// ones that were left out from base
+func (p *configParser) parseResponse(path []interface{}, axis glfw.GamepadAxis, base AxisResponse, options AxisOptions) AxisResponse {
+	response := base
+	// Problems that come from settings together are put on the one that was set
+	setting := func(name string, set bool) []interface{} {
+		if set {
+			return at(path, name)
+		}
+		return path
+	}
+
+	if options.Deadzone != nil {
+		response.Deadzone = *options.Deadzone
+		if response.Deadzone < 0 || response.Deadzone >= 1 {
+			p.fail(at(path, "deadzone"), "deadzone must be between 0 and 1")
+		}
+	}
+	if options.OuterDeadzone != nil {
+		response.OuterDeadzone = *options.OuterDeadzone
+		if response.OuterDeadzone < 0 || response.OuterDeadzone >= 1 {
+			p.fail(at(path, "outer_deadzone"), "outer deadzone must be between 0 and 1")
+		}
+	}
+	if response.Deadzone >= 0 && response.OuterDeadzone >= 0 && response.Deadzone+response.OuterDeadzone >= 1 {
+		p.fail(setting("outer_deadzone", options.OuterDeadzone != nil), "deadzone and outer deadzone leave nothing of the axis")
+	}
+	if options.Sensitivity != nil {
+		response.Sensitivity = *options.Sensitivity
+		if response.Sensitivity < 0 {
+			p.fail(at(path, "sensitivity"), "sensitivity must be positive")
+		}
+	}
+	if options.Radial != nil {
+		response.Radial = *options.Radial
+		if isTrigger(axis) && response.Radial {
+			p.fail(at(path, "radial"), "triggers can't have a radial deadzone")
+		}
+	}
+	if options.Invert != nil {
+		response.Invert = *options.Invert
+		if isTrigger(axis) && response.Invert {
+			p.fail(at(path, "invert"), "triggers can't be inverted")
+		}
+	}
+	if options.Exponent != nil {
+		response.Exponent = *options.Exponent
+		if response.Exponent <= 0 {
+			p.fail(at(path, "exponent"), "exponent must be positive")
+		}
+	}
+	if options.Points != nil {
+		response.Points = options.Points
+	}
+
+	if options.Curve != nil {
+		response.Curve = *options.Curve
+	}
+	switch response.Curve {
+	case CURVE_LINEAR, CURVE_EXPONENTIAL:
+		if len(response.Points) > 0 {
+			p.fail(setting("points", options.Points != nil), "points are only used by the %s curve", CURVE_CUSTOM)
+		}
+	case CURVE_CUSTOM:
+		p.checkPoints(setting("points", options.Points != nil), response.Points)
+	default:
+		p.fail(at(path, "curve"), "curve must be %s, %s or %s, got %s", CURVE_LINEAR, CURVE_EXPONENTIAL, CURVE_CUSTOM, response.Curve)
+	}
+	return response
+}
+
+// checkPoints makes sure a custom curve goes all the way from 0 to 1
+func (p *configParser) checkPoints(path []interface{}, points [][2]float32) {
+	if len(points) < 2 {
+		p.fail(path, "a %s curve needs at least 2 points", CURVE_CUSTOM)
+		return
+	}
+	for i, point := range points {
+		if point[0] < 0 || point[0] > 1 || point[1] < 0 || point[1] > 1 {
+			p.fail(at(path, i), "points of a curve must be between 0 and 1")
+		} else if i > 0 && point[0] <= points[i-1][0] {
+			p.fail(at(path, i), "points of a curve must go from left to right")
+		}
+	}
+	if points[0][0] != 0 || points[len(points)-1][0] != 1 {
+		p.fail(path, "a %s curve has to start at x 0 and end at x 1", CURVE_CUSTOM)
+	}
+}
+
+// parseChord parses buttons that have to be held together
+func (p *configParser) parseChord(path []interface{}, what string, inputs []string) []glfw.GamepadButton {
+	chord := make([]glfw.GamepadButton, 0, len(inputs))
+	for i, input := range inputs {
+		rule, err := parseRule(input)
+		if err != nil || rule.Type != Button {
+			p.fail(at(path, i), "%s can only use buttons, got %s", what, input)
+			continue
+		}
+		chord = append(chord, rule.Button)
+	}
+	return chord
+}
+
+// checkMultiplexer makes sure a multiplexer can be built from its settings
+func (p *configParser) checkMultiplexer(path []interface{}, config MultiplexerConfig) {
+	errs := len(p.errs)
+	p.parseChord(at(path, "turn_chord"), "turn chord", config.TurnChord)
+	if len(p.errs) > errs {
+		return
+	}
+
+	_, err := newMultiplexer(config)
+	if err != nil {
+		p.fail(path, "%s", err)
+	}
+}
+
+// Every key robotgo can press by name, from the key_names table it looks
+// them up in. Any single character works too
+var keyNames = func() map[string]bool {
+	names := make(map[string]bool)
+	for _, name := range []string{
+		"backspace", "delete", "enter", "tab", "esc", "escape",
+		"up", "down", "right", "left", "home", "end", "pageup", "pagedown",
+		"f1", "f2", "f3", "f4", "f5", "f6", "f7", "f8", "f9", "f10", "f11", "f12",
+		"f13", "f14", "f15", "f16", "f17", "f18", "f19", "f20", "f21", "f22", "f23", "f24",
+		"cmd", "lcmd", "rcmd", "command", "alt", "lalt", "ralt",
+		"ctrl", "lctrl", "rctrl", "control", "shift", "lshift", "rshift", "right_shift",
+		"capslock", "space", "print", "printscreen", "insert", "menu",
+		"audio_mute", "audio_vol_down", "audio_vol_up", "audio_play", "audio_stop",
+		"audio_pause", "audio_prev", "audio_next", "audio_rewind", "audio_forward",
+		"audio_repeat", "audio_random",
+		"num0", "num1", "num2", "num3", "num4", "num5", "num6", "num7", "num8", "num9",
+		"num_lock", "num.", "num+", "num-", "num*", "num/", "num_clear", "num_enter", "num_equal",
+		"numpad_0", "numpad_1", "numpad_2", "numpad_3", "numpad_4",
+		"numpad_5", "numpad_6", "numpad_7", "numpad_8", "numpad_9", "numpad_lock",
+		"lights_mon_up", "lights_mon_down", "lights_kbd_toggle", "lights_kbd_up", "lights_kbd_down",
+		// Ours, for the mouse
+		MOUSE_LEFT, MOUSE_RIGHT, MOUSE_CENTER, SCROLL_UP, SCROLL_DOWN,
+	} {
+		names[name] = true
+	}
+	return names
+}()
+
+// validKey is whether the keyboard output can press a key
+func validKey(key string) bool {
+	return len(key) == 1 && key[0] > ' ' && key[0] <= '~' || keyNames[key]
+}
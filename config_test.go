@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// loadConfigString writes the config to a file and loads it
+func loadConfigString(t *testing.T, config string) (ServerConfig, error) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "gpmux.yml")
+	if err := ioutil.WriteFile(file, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return loadConfig(file)
+}
+
+// expectConfigErrors checks that loading the config fails with exactly these
+// errors, in order
+func expectConfigErrors(t *testing.T, config string, want ...ConfigError) {
+	t.Helper()
+	_, err := loadConfigString(t, config)
+	errs, ok := err.(ConfigErrors)
+	if !ok {
+		t.Fatalf("got %v, want ConfigErrors", err)
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("got %d errors, want %d:\n%s", len(errs), len(want), errs)
+	}
+	for i := range want {
+		if errs[i] != want[i] {
+			t.Errorf("error %d is %q, want %q", i, errs[i], want[i])
+		}
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   ConfigError
+	}{
+		{
+			"unknown button",
+			"clients:\n  alice:\n    joystick0: [BUTTON_A, BUTTON_Z]\n",
+			ConfigError{3, "client alice: Unrecognized BUTTON or AXIS BUTTON_Z"},
+		},
+		{
+			"joystick out of range",
+			"clients:\n  alice:\n    joystick0: [BUTTON_A]\n    joystick16: [BUTTON_B]\n",
+			ConfigError{4, "client alice: joystick number of joystick16 must be from 0 to 15"},
+		},
+		{
+			"axis with one key",
+			"mapping:\n  BUTTON_A: a\n  AXIS_LEFT_X: left\n",
+			ConfigError{3, "rule AXIS_LEFT_X requires 2 key outputs, for example AXIS_LEFT_X: left right"},
+		},
+		{
+			"unknown key",
+			"mapping:\n  AXIS_LEFT_Y: up dwn\n",
+			ConfigError{2, "unknown key dwn for AXIS_LEFT_Y"},
+		},
+		{
+			"unknown mapping",
+			"mapping:\n  BUTTON_A: a\n  BUTTON_Q: b\n",
+			ConfigError{3, "Unrecognized BUTTON or AXIS BUTTON_Q"},
+		},
+		{
+			"misspelled setting",
+			"mapping:\n  BUTTON_A: a\nmultiplexr:\n  mode: vote\n",
+			ConfigError{3, "field multiplexr not found in type main.Config"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			expectConfigErrors(t, test.config, test.want)
+		})
+	}
+}
+
+func TestConfigEveryError(t *testing.T) {
+	// Nothing stops at the first mistake, every one is found with its line
+	expectConfigErrors(t, `clients:
+  alice:
+    joystick15: [BUTTON_A]
+    joystick16: [BUTTON_A]
+    joystick1: [BUTTON_A, BUTTON_Z]
+mapping:
+  BUTTON_A: zz
+  AXIS_LEFT_X: left
+  AXIS_LEFT_Y: up dwn
+`,
+		ConfigError{4, "client alice: joystick number of joystick16 must be from 0 to 15"},
+		ConfigError{5, "client alice: Unrecognized BUTTON or AXIS BUTTON_Z"},
+		ConfigError{7, "unknown key zz for BUTTON_A"},
+		ConfigError{8, "rule AXIS_LEFT_X requires 2 key outputs, for example AXIS_LEFT_X: left right"},
+		ConfigError{9, "unknown key dwn for AXIS_LEFT_Y"},
+	)
+}
+
+func TestConfigSample(t *testing.T) {
+	if _, err := loadConfig(filepath.Join("configs", "gpmux.yml")); err != nil {
+		t.Fatalf("the sample config doesn't load: %s", err)
+	}
+}
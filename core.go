@@ -0,0 +1,223 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/go-gl/glfw/v3.3/glfw"
+)
+
+// Kinds of events the server core handles
+const (
+	// A joystick sent its state
+	EVENT_GAMESTATE = iota
+	// A client left, let go of its joysticks
+	EVENT_FORGET
+	// Something else wants to run on the core, like an admin command
+	EVENT_COMMAND
+)
+
+// Event is something that can change the virtual gamepad
+type Event struct {
+	Kind int
+
+	// EVENT_GAMESTATE, State is masked to the joystick's rules and Unmasked
+	// isn't. Session is who sent it or nil to trust it
+	Id       InputId
+	State    glfw.GamepadState
+	Unmasked glfw.GamepadState
+	Session  *ServerConn
+	// EVENT_FORGET
+	Client uint8
+	// EVENT_COMMAND
+	Command func(core *Core)
+}
+
+// events feeds everything that happens on the server to the core
+var events = make(chan Event, 256)
+
+// Core owns the state of every joystick and turns it into the virtual
+// gamepad. It runs on a single goroutine, everything else talks to it by
+// sending events so the gamepad is updated as soon as something changes
+type Core struct {
+	Multiplexer Multiplexer
+	Output      Output
+	// Quiet joysticks are let go of after Timeout and forgotten after Evict
+	Timeout time.Duration
+	Evict   time.Duration
+	Verbose bool
+	// Nothing reaches the output while paused
+	Paused bool
+	// Games the server can switch between, and the buttons that switch
+	Profiles     map[string]Profile
+	ProfileChord []glfw.GamepadButton
+	// The responses every session shapes axes with, filled in from the
+	// profile being played
+	Responses ClientResponses
+
+	states      StatesMap
+	unmasked    StatesMap
+	seen        map[InputId]time.Time
+	multiplexed glfw.GamepadState
+	profile     string
+	// Joysticks that held the profile chord and haven't let go of it yet
+	chording map[InputId]bool
+}
+
+func newCore(multiplexer Multiplexer, output Output, timeout, evict time.Duration) *Core {
+	core := &Core{
+		Multiplexer: multiplexer,
+		Output:      output,
+		Timeout:     timeout,
+		Evict:       evict,
+		states:      make(StatesMap),
+		unmasked:    make(StatesMap),
+		seen:        make(map[InputId]time.Time),
+		chording:    make(map[InputId]bool),
+	}
+	rest(&core.multiplexed)
+	return core
+}
+
+// Run handles events until the channel closes. The gamepad is also updated
+// every Interval for the things that change on their own, like the mouse
+// moving, turns running out and joysticks going quiet
+func (c *Core) Run(events <-chan Event) error {
+	ticker := time.NewTicker(Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return nil
+			}
+			c.handle(event)
+
+			// Take everything else that's waiting so a burst only multiplexes once
+			for drained := false; !drained; {
+				select {
+				case event, ok := <-events:
+					if !ok {
+						return nil
+					}
+					c.handle(event)
+				default:
+					drained = true
+				}
+			}
+		case now := <-ticker.C:
+			c.expire(now)
+		}
+
+		err := c.update()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (c *Core) handle(event Event) {
+	switch event.Kind {
+	case EVENT_GAMESTATE:
+		// Packets that were on their way when their client left come after
+		// the client was forgotten, and must not bring its joysticks back
+		if event.Session != nil && !event.Session.live() {
+			return
+		}
+		c.states[event.Id] = event.State
+		c.unmasked[event.Id] = event.Unmasked
+		c.seen[event.Id] = time.Now()
+	case EVENT_FORGET:
+		for id := range c.states {
+			if id.Client == event.Client {
+				delete(c.states, id)
+				delete(c.unmasked, id)
+				delete(c.seen, id)
+			}
+		}
+	case EVENT_COMMAND:
+		event.Command(c)
+	}
+}
+
+// expire lets go of the joysticks the server stopped hearing from
+func (c *Core) expire(now time.Time) {
+	for id, seen := range c.seen {
+		quiet := now.Sub(seen)
+		if quiet >= c.Evict {
+			log.Printf("Joystick %d of client %d has been quiet for %s, forgetting it\n",
+				id.Device, id.Client, quiet.Round(time.Second))
+			delete(c.states, id)
+			delete(c.unmasked, id)
+			delete(c.seen, id)
+		} else if quiet >= c.Timeout {
+			state := c.states[id]
+			if state != resting {
+				log.Printf("Joystick %d of client %d has been quiet for %s, releasing its inputs\n",
+					id.Device, id.Client, quiet.Round(time.Millisecond))
+				c.states[id] = resting
+				c.unmasked[id] = resting
+			}
+		}
+	}
+}
+
+// quiet finds the joysticks that haven't been heard from for Timeout
+func (c *Core) quiet(now time.Time) map[InputId]bool {
+	quiet := make(map[InputId]bool)
+	for id, seen := range c.seen {
+		if now.Sub(seen) >= c.Timeout {
+			quiet[id] = true
+		}
+	}
+	return quiet
+}
+
+// update multiplexes the joysticks and hands the result to the output
+func (c *Core) update() error {
+	// Anyone holding the profile chord moves everyone on to the next game
+	rules := connectedRules()
+	if c.profileChordPressed(rules) {
+		c.nextProfile()
+	}
+
+	// Chords are read from everything a joystick presses, not just what it's
+	// allowed to, and clients that went quiet don't get to sit on the turn
+	if turns, ok := c.Multiplexer.(*TurnMultiplexer); ok {
+		turns.WatchChord(c.unmasked)
+		turns.WatchQuiet(c.quiet(time.Now()))
+	}
+
+	// Every joystick of every client is its own input. The profile chord
+	// only switches profiles, the game never sees it
+	c.Multiplexer.Multiplex(rules, c.withoutProfileChord(), &c.multiplexed)
+	if c.Verbose {
+		log.Println(c.multiplexed)
+	}
+
+	// Let go of everything while paused
+	if c.Paused {
+		state := resting
+		return c.Output.Emit(&state)
+	}
+	return c.Output.Emit(&c.multiplexed)
+}
+
+// SetMultiplexer swaps how the joysticks get merged together
+func (c *Core) SetMultiplexer(multiplexer Multiplexer) {
+	if turns, ok := multiplexer.(*TurnMultiplexer); ok {
+		turns.OnTurn = notifyTurn
+	}
+	c.Multiplexer = multiplexer
+}
+
+// runOnCore runs fn on the core's goroutine and waits for it to finish
+func runOnCore(fn func(core *Core)) {
+	done := make(chan struct{})
+	events <- Event{Kind: EVENT_COMMAND, Command: func(core *Core) {
+		fn(core)
+		close(done)
+	}}
+	<-done
+}
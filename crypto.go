@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Mixed into the key derivation so keys made for gpmux can't be reused elsewhere
+const keyInfo = "gpmux session keys"
+
+// KeyPair is one side's half of the X25519 key exchange
+type KeyPair struct {
+	Private [curve25519.ScalarSize]byte
+	Public  []byte
+}
+
+func newKeyPair() (*KeyPair, error) {
+	keys := &KeyPair{}
+	_, err := rand.Read(keys.Private[:])
+	if err != nil {
+		return nil, err
+	}
+
+	keys.Public, err = curve25519.X25519(keys.Private[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Negotiation is what a client offered and what the server agreed to in the
+// plaintext handshake. Both sides mix it into the keys, so a man in the middle
+// who changes either side's capabilities ends up with keys that don't match
+type Negotiation struct {
+	OfferedVersion      uint8
+	OfferedCapabilities uint32
+	Version             uint8
+	Capabilities        uint32
+}
+
+// Bytes lays the negotiation out the same way on both sides
+func (n Negotiation) Bytes() []byte {
+	data := make([]byte, 10)
+	data[0] = n.OfferedVersion
+	binary.BigEndian.PutUint32(data[1:], n.OfferedCapabilities)
+	data[5] = n.Version
+	binary.BigEndian.PutUint32(data[6:], n.Capabilities)
+	return data
+}
+
+// SessionKeys seal everything a session sends after the key exchange.
+// Each direction gets its own key so their nonces can't collide
+type SessionKeys struct {
+	ClientControl  cipher.AEAD
+	ServerControl  cipher.AEAD
+	ClientDatagram cipher.AEAD
+}
+
+// deriveKeys turns the shared X25519 secret into the session's AES-GCM keys.
+// The session token and the optional shared secret salt the derivation, so a
+// man in the middle who doesn't know the secret ends up with different keys.
+// The negotiation is bound in too so the handshake can't be talked down
+func deriveKeys(
+	keys *KeyPair,
+	peerPublic []byte,
+	clientPublic []byte,
+	serverPublic []byte,
+	token SessionToken,
+	secret []byte,
+	negotiation Negotiation,
+) (*SessionKeys, error) {
+	shared, err := curve25519.X25519(keys.Private[:], peerPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := append(token[:], secret...)
+	info := append([]byte(keyInfo), clientPublic...)
+	info = append(info, serverPublic...)
+	info = append(info, negotiation.Bytes()...)
+	kdf := hkdf.New(sha256.New, shared, salt, info)
+
+	aeads := make([]cipher.AEAD, 3)
+	for i := range aeads {
+		key := make([]byte, 32)
+		_, err = io.ReadFull(kdf, key)
+		if err != nil {
+			return nil, err
+		}
+		aeads[i], err = newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &SessionKeys{
+		ClientControl:  aeads[0],
+		ServerControl:  aeads[1],
+		ClientDatagram: aeads[2],
+	}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// controlNonce builds the nonce of the nth sealed control packet
+func controlNonce(counter uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
+
+// datagramNonce builds the nonce of a sealed gamestate packet from its id,
+// the ids only go up so a nonce is never used twice with the same key
+func datagramNonce(packetId uint32) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint32(nonce[8:], packetId)
+	return nonce
+}
+
+var ErrKeyExchange = errors.New("key exchange failed")
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"testing/iotest"
+
+	"github.com/go-gl/glfw/v3.3/glfw"
+)
+
+// exchange runs both sides of the key exchange against each other
+func exchange(t *testing.T, client *ClientConn, server *ServerConn) {
+	clientSide, serverSide := net.Pipe()
+	t.Cleanup(func() {
+		clientSide.Close()
+		serverSide.Close()
+	})
+	client.ControlConn = NewControlStream(clientSide)
+	server.Conn = NewControlStream(serverSide)
+
+	done := make(chan error, 1)
+	go func() { done <- server.exchangeKeys() }()
+	if err := client.exchangeKeys(); err != nil {
+		t.Fatal("client's side of the key exchange failed with", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal("server's side of the key exchange failed with", err)
+	}
+}
+
+// sendOver writes a packet to one end and reads it from the other
+func sendOver(from, to *ControlStream, pkt []byte) (*ControlProtocol, error) {
+	sent := make(chan error, 1)
+	go func() { sent <- from.Write(pkt) }()
+	read, err := to.ReadPacket()
+	if err != nil {
+		// Nobody is going to read the rest of it
+		from.Close()
+	}
+	<-sent
+	return read, err
+}
+
+func TestKeyExchange(t *testing.T) {
+	token := SessionToken{1, 2, 3, 4, 5, 6, 7, 8}
+	agreed := Negotiation{PROTOCOL_VERSION, CAPABILITIES, PROTOCOL_VERSION, CAPABILITIES}
+	stripped := agreed
+	stripped.OfferedCapabilities &^= CAP_ENCRYPTION
+	downgraded := agreed
+	downgraded.Version = MIN_PROTOCOL_VERSION
+
+	tests := []struct {
+		name         string
+		client       Negotiation
+		server       Negotiation
+		clientSecret string
+		serverSecret string
+		agree        bool
+	}{
+		{"same handshake", agreed, agreed, "", "", true},
+		{"same secret", agreed, agreed, "hunter2", "hunter2", true},
+		{"different secrets", agreed, agreed, "hunter2", "hunter3", false},
+		{"only one side has a secret", agreed, agreed, "hunter2", "", false},
+		{"offer changed on the way", agreed, stripped, "", "", false},
+		{"version talked down", agreed, downgraded, "", "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &ClientConn{Token: token, Security: Security{Secret: []byte(test.clientSecret)}, negotiation: test.client}
+			server := &ServerConn{Token: token, Security: Security{Secret: []byte(test.serverSecret)}, negotiation: test.server}
+			exchange(t, client, server)
+
+			// Both directions of the control socket
+			pkt, err := sendOver(client.ControlConn, server.Conn, (&ControlProtocol{}).Done("from the client"))
+			if test.agree && (err != nil || string(pkt.Data) != "from the client") {
+				t.Fatalf("server read %v with error %v", pkt, err)
+			} else if !test.agree && !errors.Is(err, ErrBadSeal) {
+				t.Fatalf("server read with error %v, want %v", err, ErrBadSeal)
+			}
+			if test.agree {
+				pkt, err = sendOver(server.Conn, client.ControlConn, (&ControlProtocol{}).Done("from the server"))
+				if err != nil || string(pkt.Data) != "from the server" {
+					t.Fatalf("client read %v with error %v", pkt, err)
+				}
+			}
+
+			// And the gamestate packets
+			sent := GamestateProtocol{PacketId: 1, ClientId: 3, Token: token, GamepadState: gamepad(glfw.ButtonA)}
+			opened := &GamestateProtocol{}
+			err = opened.Open(server.datagramCipher, sent.Seal(client.datagramCipher))
+			if test.agree && (err != nil || opened.GamepadState != sent.GamepadState) {
+				t.Fatalf("server opened %v with error %v", opened.GamepadState, err)
+			} else if !test.agree && err == nil {
+				t.Fatal("server opened a gamestate packet sealed with different keys")
+			}
+		})
+	}
+}
+
+func TestSealedTampering(t *testing.T) {
+	token := SessionToken{1, 2, 3, 4, 5, 6, 7, 8}
+	agreed := Negotiation{PROTOCOL_VERSION, CAPABILITIES, PROTOCOL_VERSION, CAPABILITIES}
+	client := &ClientConn{Token: token, negotiation: agreed}
+	server := &ServerConn{Token: token, negotiation: agreed}
+	exchange(t, client, server)
+
+	sent := GamestateProtocol{PacketId: 7, ClientId: 3, DeviceId: 1, Token: token, GamepadState: gamepad(glfw.ButtonA)}
+	sealed := sent.Seal(client.datagramCipher)
+	if bytes.Contains(sealed, token[:]) {
+		t.Fatal("the token was sent in the clear")
+	}
+
+	tests := []struct {
+		name   string
+		tamper func(data []byte) []byte
+	}{
+		{"state changed", func(data []byte) []byte { data[gamestateHeaderLen+10] ^= 1; return data }},
+		{"tag changed", func(data []byte) []byte { data[len(data)-1] ^= 1; return data }},
+		{"packet id changed", func(data []byte) []byte { data[3]++; return data }},
+		{"client id changed", func(data []byte) []byte { data[4]++; return data }},
+		{"joystick changed", func(data []byte) []byte { data[5]++; return data }},
+		{"cut short", func(data []byte) []byte { return data[:len(data)-1] }},
+		{"only the header", func(data []byte) []byte { return data[:gamestateHeaderLen] }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := test.tamper(append([]byte{}, sealed...))
+			if err := (&GamestateProtocol{}).Open(server.datagramCipher, data); err == nil {
+				t.Fatal("opened a tampered packet")
+			}
+		})
+	}
+
+	// A sealed control packet with a byte flipped fails too
+	var wire bytes.Buffer
+	writer := NewControlStream(&streamConn{w: &wire})
+	writer.Encrypt(client.ControlConn.send, nil)
+	writer.Write((&ControlProtocol{}).Done("bye"))
+	data := wire.Bytes()
+	data[len(data)-1] ^= 1
+	reader := readStream(data, iotest.OneByteReader)
+	reader.Encrypt(nil, server.Conn.recv)
+	if _, err := reader.ReadPacket(); !errors.Is(err, ErrBadSeal) {
+		t.Fatalf("tampered control packet read with error %v, want %v", err, ErrBadSeal)
+	}
+}
+
+func TestReplays(t *testing.T) {
+	token := SessionToken{1, 2, 3, 4, 5, 6, 7, 8}
+	agreed := Negotiation{PROTOCOL_VERSION, CAPABILITIES, PROTOCOL_VERSION, CAPABILITIES}
+	client := &ClientConn{Token: token, negotiation: agreed}
+	server := &ServerConn{Token: token, negotiation: agreed}
+	exchange(t, client, server)
+
+	// Gamestate packets open on their own, so the packet id is what stops a
+	// replay or a packet id used twice
+	packets := []struct {
+		name  string
+		id    uint32
+		fresh bool
+	}{
+		{"first packet", 1, true},
+		{"replayed", 1, false},
+		{"next packet", 2, true},
+		{"skipped ahead", 5, true},
+		{"came late", 4, false},
+		{"id used again", 5, false},
+	}
+	for i, p := range packets {
+		// Every packet presses something different so reused ids seal different data
+		sent := GamestateProtocol{PacketId: p.id, ClientId: 3, Token: token}
+		sent.GamepadState = with(resting, glfw.AxisLeftX, float32(i)/10)
+		opened := &GamestateProtocol{}
+		if err := opened.Open(server.datagramCipher, sent.Seal(client.datagramCipher)); err != nil {
+			t.Fatalf("%s: opening failed with %s", p.name, err)
+		}
+		if fresh := server.fresh(opened); fresh != p.fresh {
+			t.Fatalf("%s: fresh %v, want %v", p.name, fresh, p.fresh)
+		}
+	}
+
+	// Sealed control packets have to come in the order they were sent
+	var wire bytes.Buffer
+	writer := NewControlStream(&streamConn{w: &wire})
+	writer.Encrypt(client.ControlConn.send, nil)
+	writer.Write((&ControlProtocol{}).Done("first"))
+	first := append([]byte{}, wire.Bytes()...)
+	writer.Write((&ControlProtocol{}).Done("second"))
+	second := wire.Bytes()[len(first):]
+
+	streams := []struct {
+		name string
+		data []byte
+	}{
+		{"replayed", append(append([]byte{}, first...), first...)},
+		{"reordered", append(append([]byte{}, second...), first...)},
+	}
+	for _, s := range streams {
+		reader := readStream(s.data, iotest.HalfReader)
+		reader.Encrypt(nil, server.Conn.recv)
+		var err error
+		for err == nil {
+			_, err = reader.ReadPacket()
+		}
+		if !errors.Is(err, ErrBadSeal) {
+			t.Fatalf("%s: read with error %v, want %v", s.name, err, ErrBadSeal)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// The biggest control packet either side is willing to read
+const MaxFrameSize = 64 * 1024
+
+// Length of the type and length in front of every control packet
+const frameHeaderLen = 5
+
+// Sealed packets carry an 8 byte counter and a 16 byte tag on top of the packet inside
+const sealOverhead = 8 + 16
+
+var ErrFrameTooLarge = errors.New("control packet is larger than the maximum frame size")
+var ErrBadSeal = errors.New("control packet failed to decrypt")
+
+// ControlStream reads and writes whole ControlProtocol packets over a TCP
+// connection. TCP is free to split a packet across reads or pack several
+// into one, so packets are rebuilt from their length prefix.
+// Once Encrypt is called every packet is wrapped in a SEALED packet
+type ControlStream struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	// Several goroutines can send packets at the same time
+	writeLock sync.Mutex
+
+	// Counters number the sealed packets so they can't be replayed or reordered
+	send        cipher.AEAD
+	sendCounter uint64
+	recv        cipher.AEAD
+	recvCounter uint64
+}
+
+func NewControlStream(conn net.Conn) *ControlStream {
+	return &ControlStream{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+}
+
+// ReadPacket blocks until a whole packet has arrived. Any error means the
+// stream can't be trusted to be lined up with the packets anymore
+func (s *ControlStream) ReadPacket() (*ControlProtocol, error) {
+	header := make([]byte, frameHeaderLen)
+	_, err := io.ReadFull(s.reader, header)
+	if err != nil {
+		return nil, err
+	}
+
+	pkt := &ControlProtocol{
+		Type: header[0],
+		Len:  binary.BigEndian.Uint32(header[1:]),
+	}
+	// A sealed packet carries a whole packet, header and all
+	if pkt.Len > frameHeaderLen+MaxFrameSize+sealOverhead {
+		return nil, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, pkt.Len)
+	}
+
+	pkt.Data = make([]byte, pkt.Len)
+	_, err = io.ReadFull(s.reader, pkt.Data)
+	if err == io.EOF {
+		// The connection closed part way through the packet
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if s.recv != nil {
+		return s.open(pkt)
+	} else if pkt.Type == SEALED {
+		return nil, fmt.Errorf("%w: encryption was never set up", ErrBadSeal)
+	} else if pkt.Len > MaxFrameSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, pkt.Len)
+	}
+
+	return pkt, nil
+}
+
+// open unwraps the packet inside a SEALED packet
+func (s *ControlStream) open(sealed *ControlProtocol) (*ControlProtocol, error) {
+	if sealed.Type != SEALED || len(sealed.Data) < sealOverhead {
+		return nil, fmt.Errorf("%w: expecting an encrypted packet", ErrBadSeal)
+	}
+
+	// Packets have to arrive in the order they were sent
+	counter := binary.BigEndian.Uint64(sealed.Data)
+	if counter != s.recvCounter {
+		return nil, fmt.Errorf("%w: packet %d arrived when expecting %d", ErrBadSeal, counter, s.recvCounter)
+	}
+
+	data, err := s.recv.Open(nil, controlNonce(counter), sealed.Data[8:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBadSeal, err.Error())
+	}
+	s.recvCounter++
+
+	// What's inside is a whole packet of its own
+	if len(data) < frameHeaderLen || int(binary.BigEndian.Uint32(data[1:])) != len(data)-frameHeaderLen {
+		return nil, fmt.Errorf("%w: packet inside is malformed", ErrBadSeal)
+	}
+	return &ControlProtocol{
+		Type: data[0],
+		Len:  uint32(len(data) - frameHeaderLen),
+		Data: data[frameHeaderLen:],
+	}, nil
+}
+
+// Write sends a packet made by one of the ControlProtocol builders
+func (s *ControlStream) Write(pkt []byte) error {
+	if len(pkt)-frameHeaderLen > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	if s.send != nil {
+		// Wrap the whole packet up in a SEALED packet
+		data := make([]byte, 8, sealOverhead+len(pkt))
+		binary.BigEndian.PutUint64(data, s.sendCounter)
+		data = s.send.Seal(data, controlNonce(s.sendCounter), pkt, nil)
+		s.sendCounter++
+		pkt = (&ControlProtocol{}).Sealed(data)
+	}
+
+	_, err := s.conn.Write(pkt)
+	return err
+}
+
+// Encrypt seals every packet written from now on with send, and only
+// accepts packets sealed with recv. Must not be called while a read is going
+func (s *ControlStream) Encrypt(send, recv cipher.AEAD) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	s.send = send
+	s.recv = recv
+}
+
+// SetReadDeadline makes ReadPacket give up if nothing arrives before t
+func (s *ControlStream) SetReadDeadline(t time.Time) error {
+	return s.conn.SetReadDeadline(t)
+}
+
+func (s *ControlStream) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *ControlStream) Close() error {
+	return s.conn.Close()
+}
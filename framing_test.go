@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// streamConn is a connection that reads from r and writes to w
+type streamConn struct {
+	net.Conn
+	r io.Reader
+	w io.Writer
+}
+
+func (c *streamConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *streamConn) Write(p []byte) (int, error) { return c.w.Write(p) }
+
+// readStream reads packets out of data the way split reads hand it over
+func readStream(data []byte, split func(io.Reader) io.Reader) *ControlStream {
+	return NewControlStream(&streamConn{r: split(bytes.NewReader(data))})
+}
+
+// frame is a packet header claiming length bytes, followed by them
+func frame(pktType uint8, length uint32, data []byte) []byte {
+	return append((&ControlProtocol{Type: pktType, Len: length}).Bytes(), data...)
+}
+
+func TestControlStreamRoundTrip(t *testing.T) {
+	token := SessionToken{1, 2, 3, 4, 5, 6, 7, 8}
+	peripheral := Peripheral{3, "030000005e0400008e02000010010000", "Xbox Controller"}
+	rumble := Rumble{Strong: 0x8000, Weak: 0x4000, Duration: 250 * time.Millisecond}
+	ping := &ControlProtocol{}
+	ping.Ping(123456789)
+
+	packets := []struct {
+		name  string
+		pkt   []byte
+		parse func(p *ControlProtocol) (interface{}, error)
+		want  interface{}
+	}{
+		{"error", (&ControlProtocol{}).Error("please update"), nil, nil},
+		{"register", (&ControlProtocol{}).Register(PROTOCOL_VERSION, CAPABILITIES, "alice"),
+			func(p *ControlProtocol) (interface{}, error) {
+				version, capabilities, name, err := p.ParseRegister()
+				return []interface{}{version, capabilities, name}, err
+			}, []interface{}{PROTOCOL_VERSION, CAPABILITIES, "alice"}},
+		{"resume", (&ControlProtocol{}).Resume(PROTOCOL_VERSION, CAP_RUMBLE, token, "alice"),
+			func(p *ControlProtocol) (interface{}, error) {
+				version, capabilities, resume, name, err := p.ParseResume()
+				return []interface{}{version, capabilities, resume, name}, err
+			}, []interface{}{PROTOCOL_VERSION, CAP_RUMBLE, token, "alice"}},
+		{"resume token", (&ControlProtocol{}).ResumeToken(token),
+			func(p *ControlProtocol) (interface{}, error) { return p.ParseResumeToken() }, token},
+		{"set id", (&ControlProtocol{}).SetId(7, PROTOCOL_VERSION, CAP_COMPRESSION, token),
+			func(p *ControlProtocol) (interface{}, error) {
+				id, version, capabilities, token, err := p.ParseSetId()
+				return []interface{}{id, version, capabilities, token}, err
+			}, []interface{}{uint8(7), PROTOCOL_VERSION, CAP_COMPRESSION, token}},
+		{"configuration", (&ControlProtocol{}).Configure([]byte{0, 1, 2, 3}), nil, nil},
+		{"done", (&ControlProtocol{}).Done("kicked by an admin"), nil, nil},
+		{"turn start", (&ControlProtocol{}).TurnStart(), nil, nil},
+		{"turn end", (&ControlProtocol{}).TurnEnd(), nil, nil},
+		{"ping", ping.Bytes(), nil, nil},
+		{"pong", (&ControlProtocol{}).Pong(ping), nil, nil},
+		{"rumble", (&ControlProtocol{}).Rumble(2, rumble),
+			func(p *ControlProtocol) (interface{}, error) {
+				joystick, effect, err := p.ParseRumble()
+				return []interface{}{joystick, effect}, err
+			}, []interface{}{uint8(2), rumble}},
+		{"peripheral connect", (&ControlProtocol{}).PeripheralConnect(peripheral),
+			func(p *ControlProtocol) (interface{}, error) { return p.ParsePeripheralConnect() }, peripheral},
+		{"peripheral disconnect", (&ControlProtocol{}).PeripheralDisconnect(3),
+			func(p *ControlProtocol) (interface{}, error) { return p.ParsePeripheralDisconnect() }, uint8(3)},
+		{"key exchange", (&ControlProtocol{}).KeyExchange(bytes.Repeat([]byte{9}, 32)), nil, nil},
+		{"largest packet", (&ControlProtocol{}).Configure(make([]byte, MaxFrameSize)), nil, nil},
+	}
+
+	clientKey, _ := newAEAD(bytes.Repeat([]byte{1}, 32))
+	serverKey, _ := newAEAD(bytes.Repeat([]byte{2}, 32))
+	for _, sealed := range []bool{false, true} {
+		// Everything is written to one stream and read back one byte at a time
+		var wire bytes.Buffer
+		writer := NewControlStream(&streamConn{w: &wire})
+		if sealed {
+			writer.Encrypt(clientKey, serverKey)
+		}
+		for _, p := range packets {
+			if err := writer.Write(p.pkt); err != nil {
+				t.Fatalf("%s: writing failed with %s", p.name, err)
+			}
+		}
+
+		reader := readStream(wire.Bytes(), iotest.OneByteReader)
+		if sealed {
+			reader.Encrypt(serverKey, clientKey)
+		}
+		for _, p := range packets {
+			pkt, err := reader.ReadPacket()
+			if err != nil {
+				t.Fatalf("%s, sealed %v: reading failed with %s", p.name, sealed, err)
+			}
+			if !bytes.Equal(pkt.Bytes(), p.pkt) {
+				t.Fatalf("%s, sealed %v: read type %d with %d bytes, want the packet that was written",
+					p.name, sealed, pkt.Type, pkt.Len)
+			}
+			if p.parse == nil {
+				continue
+			}
+			got, err := p.parse(pkt)
+			if err != nil || !reflect.DeepEqual(got, p.want) {
+				t.Fatalf("%s, sealed %v: parsed %v with error %v, want %v", p.name, sealed, got, err, p.want)
+			}
+		}
+		if _, err := reader.ReadPacket(); err != io.EOF {
+			t.Fatalf("sealed %v: reading past the last packet gave %v, want EOF", sealed, err)
+		}
+	}
+}
+
+func TestControlStreamReads(t *testing.T) {
+	done := (&ControlProtocol{}).Done("bye")
+	twice := append(append([]byte{}, done...), done...)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		split   func(io.Reader) io.Reader
+		packets int
+		err     error
+	}{
+		{"one byte at a time", twice, iotest.OneByteReader, 2, io.EOF},
+		{"half at a time", twice, iotest.HalfReader, 2, io.EOF},
+		{"several in one read", twice, func(r io.Reader) io.Reader { return r }, 2, io.EOF},
+		{"error with the last bytes", twice, iotest.DataErrReader, 2, io.EOF},
+		{"empty packet", (&ControlProtocol{}).TurnStart(), iotest.OneByteReader, 1, io.EOF},
+		{"cut off in the header", done[:3], iotest.OneByteReader, 0, io.ErrUnexpectedEOF},
+		{"cut off in the data", done[:len(done)-1], iotest.OneByteReader, 0, io.ErrUnexpectedEOF},
+		{"cut off after a packet", twice[:len(done)+2], iotest.OneByteReader, 1, io.ErrUnexpectedEOF},
+		{"nothing", nil, iotest.OneByteReader, 0, io.EOF},
+		{"read fails", nil, func(io.Reader) io.Reader { return iotest.ErrReader(net.ErrClosed) }, 0, net.ErrClosed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stream := readStream(test.data, test.split)
+			for i := 0; i < test.packets; i++ {
+				pkt, err := stream.ReadPacket()
+				if err != nil {
+					t.Fatalf("packet %d failed with %s", i, err)
+				}
+				if pkt.Type != DONE && pkt.Type != TURN_START {
+					t.Fatalf("packet %d has type %d", i, pkt.Type)
+				}
+			}
+			if _, err := stream.ReadPacket(); !errors.Is(err, test.err) {
+				t.Fatalf("ended with %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestControlStreamFrameSize(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"largest frame", frame(CONFIGURATION, MaxFrameSize, make([]byte, MaxFrameSize)), nil},
+		{"one byte too many", frame(CONFIGURATION, MaxFrameSize+1, make([]byte, MaxFrameSize+1)), ErrFrameTooLarge},
+		{"room for a seal", frame(CONFIGURATION, MaxFrameSize+sealOverhead, make([]byte, MaxFrameSize+sealOverhead)), ErrFrameTooLarge},
+		{"sealed too big", frame(SEALED, frameHeaderLen+MaxFrameSize+sealOverhead+1, nil), ErrFrameTooLarge},
+		// Nothing this big is read in, whatever the data that follows
+		{"huge length", frame(CONFIGURATION, 1<<31, nil), ErrFrameTooLarge},
+		{"sealed without encryption", frame(SEALED, 4, []byte{0, 0, 0, 0}), ErrBadSeal},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := readStream(test.data, iotest.HalfReader).ReadPacket()
+			if !errors.Is(err, test.err) {
+				t.Fatalf("read failed with %v, want %v", err, test.err)
+			}
+		})
+	}
+
+	// Writing a packet that's too big sends nothing at all
+	var wire bytes.Buffer
+	stream := NewControlStream(&streamConn{w: &wire})
+	err := stream.Write((&ControlProtocol{}).Configure(make([]byte, MaxFrameSize+1)))
+	if !errors.Is(err, ErrFrameTooLarge) || wire.Len() != 0 {
+		t.Fatalf("writing too much failed with %v and sent %d bytes", err, wire.Len())
+	}
+}
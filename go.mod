@@ -6,7 +6,8 @@ require (
 	github.com/alecthomas/kong v0.2.17
 	github.com/go-gl/glfw/v3.3/glfw v0.0.0-20210727001814-0db043d8d5be
 	github.com/go-vgo/robotgo v0.100.0
-	gopkg.in/yaml.v2 v2.4.0
+	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/go-gl/glfw/v3.3/glfw"
+)
+
+// Rumble is a force feedback effect. The magnitudes go from 0 to 0xFFFF like
+// they do in the kernel, and an effect with both at 0 stops the rumble
+type Rumble struct {
+	Strong   uint16
+	Weak     uint16
+	Duration time.Duration
+}
+
+// Longest rumble that fits in a RUMBLE packet
+const MAX_RUMBLE_DURATION time.Duration = 0xFFFF * time.Millisecond
+
+// Sent in place of a joystick to rumble all of them
+const ALL_JOYSTICKS uint8 = 0xFF
+
+// Haptics plays rumble on the controllers plugged into the client. Like
+// every other joystick function it's only called from the main thread
+type Haptics interface {
+	Rumble(joystick glfw.Joystick, effect Rumble) error
+	Close() error
+}
+
+// Names of the haptics that can be picked from the command line
+const (
+	HAPTICS_DEVICE = "device"
+	HAPTICS_FAKE   = "fake"
+	HAPTICS_OFF    = "off"
+)
+
+// newHaptics creates the haptics picked on the command line
+func newHaptics(cli CommandLine) (Haptics, error) {
+	switch cli.Haptics {
+	case HAPTICS_DEVICE:
+		return newDeviceHaptics()
+	case HAPTICS_FAKE:
+		return &FakeHaptics{}, nil
+	case HAPTICS_OFF:
+		return NoHaptics{}, nil
+	}
+
+	return nil, fmt.Errorf("unknown haptics %s", cli.Haptics)
+}
+
+// NoHaptics ignores every rumble
+type NoHaptics struct{}
+
+func (NoHaptics) Rumble(joystick glfw.Joystick, effect Rumble) error { return nil }
+func (NoHaptics) Close() error                                       { return nil }
+
+// FakeHaptics stands in for real controllers, it logs and remembers every
+// rumble it was asked to play
+type FakeHaptics struct {
+	lock   sync.Mutex
+	played []FakeRumble
+}
+
+// FakeRumble is a rumble a FakeHaptics played
+type FakeRumble struct {
+	Joystick glfw.Joystick
+	Effect   Rumble
+}
+
+func (h *FakeHaptics) Rumble(joystick glfw.Joystick, effect Rumble) error {
+	log.Printf("Rumble joystick %d strong %d weak %d for %s\n",
+		joystick, effect.Strong, effect.Weak, effect.Duration)
+
+	h.lock.Lock()
+	h.played = append(h.played, FakeRumble{joystick, effect})
+	h.lock.Unlock()
+	return nil
+}
+
+// Played returns every rumble played so far
+func (h *FakeHaptics) Played() []FakeRumble {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return append([]FakeRumble{}, h.played...)
+}
+
+func (h *FakeHaptics) Close() error { return nil }
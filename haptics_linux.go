@@ -0,0 +1,175 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/go-gl/glfw/v3.3/glfw"
+)
+
+// Force feedback from linux/input.h and linux/input-event-codes.h
+const (
+	EV_FF     = 0x15
+	FF_RUMBLE = 0x50
+)
+
+// ioc builds an ioctl request number the same way the _IOC macro does
+func ioc(dir, typ, nr, size uintptr) uintptr {
+	return dir<<30 | size<<16 | typ<<8 | nr
+}
+
+const (
+	iocWrite = 1
+	iocRead  = 2
+)
+
+// The union in struct ff_effect is as big as struct ff_periodic_effect,
+// which ends with a pointer
+const ffUnionLen = 24 + unsafe.Sizeof(uintptr(0))
+
+// struct ff_effect with the union holding a struct ff_rumble_effect
+type ffEffect struct {
+	Type      uint16
+	Id        int16
+	Direction uint16
+	Trigger   [2]uint16
+	// Length and delay in milliseconds
+	Replay [2]uint16
+	_      [2]byte
+	Strong uint16
+	Weak   uint16
+	_      [ffUnionLen - 4]byte
+}
+
+// Where the sysfs describes every input device
+const SYSFS_INPUT = "/sys/class/input"
+
+// EvdevHaptics plays rumble through the evdev device behind each joystick
+type EvdevHaptics struct {
+	devices map[glfw.Joystick]*evdevRumbler
+}
+
+// evdevRumbler is an open evdev device and the effect uploaded to it
+type evdevRumbler struct {
+	file   *os.File
+	effect ffEffect
+}
+
+func newDeviceHaptics() (Haptics, error) {
+	return &EvdevHaptics{devices: make(map[glfw.Joystick]*evdevRumbler)}, nil
+}
+
+func (h *EvdevHaptics) Rumble(joystick glfw.Joystick, effect Rumble) error {
+	device, exists := h.devices[joystick]
+	if !exists {
+		var err error
+		device, err = openRumbler(joystick)
+		if err != nil {
+			return err
+		}
+		h.devices[joystick] = device
+	}
+
+	err := device.play(effect)
+	if err != nil {
+		// The joystick was probably unplugged, find it again next time
+		device.file.Close()
+		delete(h.devices, joystick)
+	}
+	return err
+}
+
+func (h *EvdevHaptics) Close() error {
+	for joystick, device := range h.devices {
+		device.file.Close()
+		delete(h.devices, joystick)
+	}
+	return nil
+}
+
+// openRumbler finds the evdev device of a joystick by its name. When there
+// are several controllers with the same name they're matched up in order
+func openRumbler(joystick glfw.Joystick) (*evdevRumbler, error) {
+	name := joystick.GetName()
+	nth := 0
+	for other := glfw.Joystick1; other < joystick; other++ {
+		if other.Present() && other.GetName() == name {
+			nth++
+		}
+	}
+
+	paths, err := filepath.Glob(filepath.Join(SYSFS_INPUT, "event*"))
+	if err != nil {
+		return nil, err
+	}
+	// event10 comes after event9
+	sort.Slice(paths, func(i, j int) bool {
+		if len(paths[i]) != len(paths[j]) {
+			return len(paths[i]) < len(paths[j])
+		}
+		return paths[i] < paths[j]
+	})
+
+	for _, path := range paths {
+		deviceName, err := ioutil.ReadFile(filepath.Join(path, "device", "name"))
+		if err != nil || strings.TrimSpace(string(deviceName)) != name {
+			continue
+		}
+		if nth > 0 {
+			nth--
+			continue
+		}
+
+		file, err := os.OpenFile(filepath.Join("/dev/input", filepath.Base(path)), os.O_RDWR, 0)
+		if err != nil {
+			return nil, err
+		}
+		return &evdevRumbler{file: file, effect: ffEffect{Type: FF_RUMBLE, Id: -1}}, nil
+	}
+
+	return nil, errors.New("no evdev device found for " + name)
+}
+
+// play uploads the effect, then starts it or stops it
+func (r *evdevRumbler) play(effect Rumble) error {
+	if effect.Strong == 0 && effect.Weak == 0 {
+		return r.write(0)
+	}
+
+	r.effect.Strong = effect.Strong
+	r.effect.Weak = effect.Weak
+	r.effect.Replay[0] = uint16(effect.Duration.Milliseconds())
+
+	// The kernel picks the effect's id the first time and we reuse it after that
+	request := ioc(iocWrite, 'E', 0x80, unsafe.Sizeof(r.effect))
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, r.file.Fd(), request, uintptr(unsafe.Pointer(&r.effect)))
+	if errno != 0 {
+		return errno
+	}
+
+	return r.write(1)
+}
+
+// write plays the effect count times, 0 stops it
+func (r *evdevRumbler) write(count int32) error {
+	if r.effect.Id < 0 {
+		// Nothing was ever uploaded, so nothing is playing
+		return nil
+	}
+
+	buf := &bytes.Buffer{}
+	binary.Write(buf, nativeEndian, &inputEvent{Type: EV_FF, Code: uint16(r.effect.Id), Value: count})
+	_, err := r.file.Write(buf.Bytes())
+	return err
+}
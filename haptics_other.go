@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+// newDeviceHaptics only works on linux since it talks to evdev
+func newDeviceHaptics() (Haptics, error) {
+	return nil, errors.New("device haptics are only supported on linux, try --haptics=off")
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-gl/glfw/v3.3/glfw"
+)
+
+func TestRumblePacket(t *testing.T) {
+	tests := []struct {
+		name     string
+		joystick uint8
+		effect   Rumble
+		want     Rumble
+	}{
+		{"rumble", 2, Rumble{0x8000, 0x4000, 250 * time.Millisecond}, Rumble{0x8000, 0x4000, 250 * time.Millisecond}},
+		{"strongest", ALL_JOYSTICKS, Rumble{0xFFFF, 0xFFFF, time.Second}, Rumble{0xFFFF, 0xFFFF, time.Second}},
+		{"stop", 0, Rumble{}, Rumble{}},
+		{"too long", 1, Rumble{1, 2, time.Hour}, Rumble{1, 2, MAX_RUMBLE_DURATION}},
+		{"under a millisecond", 1, Rumble{1, 2, time.Microsecond}, Rumble{1, 2, 0}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Send it over a control stream like the server does
+			server, client := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+			go NewControlStream(server).Write((&ControlProtocol{}).Rumble(test.joystick, test.effect))
+
+			pkt, err := NewControlStream(client).ReadPacket()
+			if err != nil {
+				t.Fatal(err)
+			}
+			joystick, effect, err := pkt.ParseRumble()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if joystick != test.joystick || effect != test.want {
+				t.Fatalf("got joystick %d %+v, want joystick %d %+v", joystick, effect, test.joystick, test.want)
+			}
+
+			haptics := &FakeHaptics{}
+			haptics.Rumble(glfw.Joystick(joystick), effect)
+			played := haptics.Played()
+			if len(played) != 1 || played[0] != (FakeRumble{glfw.Joystick(test.joystick), test.want}) {
+				t.Fatalf("played %+v", played)
+			}
+		})
+	}
+}
+
+func TestParseBadRumble(t *testing.T) {
+	for _, pkt := range []ControlProtocol{
+		{Type: RUMBLE, Len: 6, Data: make([]byte, 6)},
+		{Type: RUMBLE, Len: 8, Data: make([]byte, 8)},
+		{Type: PING, Len: 7, Data: make([]byte, 7)},
+	} {
+		if _, _, err := pkt.ParseRumble(); err == nil {
+			t.Errorf("parsed %+v as a rumble", pkt)
+		}
+	}
+}
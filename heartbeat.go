@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// How often each side pings the other, and how long either side waits
+// without hearing anything before it gives up on the connection
+const (
+	HEARTBEAT_INTERVAL time.Duration = time.Second
+	HEARTBEAT_TIMEOUT  time.Duration = 5 * time.Second
+)
+
+// Pings carry the time they were sent relative to this, which keeps them on
+// the monotonic clock
+var heartbeatEpoch = time.Now()
+
+// Link keeps track of how healthy the connection to a peer is
+type Link struct {
+	lock sync.Mutex
+
+	// Latest round trip time and how much it moves around
+	rtt    time.Duration
+	jitter time.Duration
+
+	// Gamestate packets that arrived and the number that should have
+	received uint64
+	expected uint64
+}
+
+// LinkStats is a snapshot of a Link
+type LinkStats struct {
+	RTT    time.Duration
+	Jitter time.Duration
+	// Fraction of gamestate packets that never showed up
+	Loss float64
+}
+
+// Ping sends a PING every HEARTBEAT_INTERVAL until the connection closes
+func (l *Link) Ping(conn *ControlStream) {
+	ticker := time.NewTicker(HEARTBEAT_INTERVAL)
+	defer ticker.Stop()
+
+	pkt := &ControlProtocol{}
+	for range ticker.C {
+		err := conn.Write(pkt.Ping(uint64(time.Since(heartbeatEpoch))))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Pong works out the round trip time from the PONG answering one of our pings
+func (l *Link) Pong(pkt *ControlProtocol) {
+	if len(pkt.Data) != 8 {
+		return
+	}
+	sent := time.Duration(binary.BigEndian.Uint64(pkt.Data))
+	rtt := time.Since(heartbeatEpoch) - sent
+	if rtt < 0 {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	// Jitter is smoothed the same way RTP does it
+	if l.rtt != 0 {
+		change := rtt - l.rtt
+		if change < 0 {
+			change = -change
+		}
+		l.jitter += (change - l.jitter) / 16
+	}
+	l.rtt = rtt
+}
+
+// Packet records the arrival of a gamestate packet, anything skipped since
+// last went missing
+func (l *Link) Packet(id, last uint32) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.received++
+	if last == 0 || id <= last {
+		l.expected++
+	} else {
+		l.expected += uint64(id - last)
+	}
+}
+
+func (l *Link) Stats() LinkStats {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	stats := LinkStats{RTT: l.rtt, Jitter: l.jitter}
+	if l.expected > 0 {
+		stats.Loss = 1 - float64(l.received)/float64(l.expected)
+	}
+	return stats
+}
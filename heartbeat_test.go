@@ -0,0 +1,76 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestLinkLoss(t *testing.T) {
+	tests := []struct {
+		name string
+		ids  []uint32
+		want float64
+	}{
+		{"nothing arrived", nil, 0},
+		{"every packet", []uint32{1, 2, 3, 4}, 0},
+		{"first packet skipped ahead", []uint32{5, 6, 7, 8}, 0},
+		{"one missing", []uint32{1, 2, 4, 5}, 0.2},
+		{"several missing", []uint32{1, 5}, 0.6},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			link := &Link{}
+			var last uint32
+			for _, id := range test.ids {
+				link.Packet(id, last)
+				last = id
+			}
+
+			if loss := link.Stats().Loss; math.Abs(loss-test.want) > 1e-9 {
+				t.Fatalf("lost %g of %v, want %g", loss, test.ids, test.want)
+			}
+		})
+	}
+}
+
+// pong answers a ping that was sent rtt ago
+func pong(link *Link, rtt time.Duration) {
+	ping := &ControlProtocol{}
+	ping.Ping(uint64(time.Since(heartbeatEpoch) - rtt))
+	link.Pong(ping)
+}
+
+func TestLinkJitter(t *testing.T) {
+	link := &Link{}
+	pong(link, 100*time.Millisecond)
+	stats := link.Stats()
+	if stats.RTT < 100*time.Millisecond || stats.RTT > 150*time.Millisecond {
+		t.Fatalf("round trip was %s, want about 100ms", stats.RTT)
+	}
+	if stats.Jitter != 0 {
+		t.Fatalf("jitter was %s after the first pong, want 0", stats.Jitter)
+	}
+
+	// A round trip 160ms longer moves the jitter a sixteenth of the way there
+	pong(link, 260*time.Millisecond)
+	stats = link.Stats()
+	if stats.Jitter < 8*time.Millisecond || stats.Jitter > 12*time.Millisecond {
+		t.Fatalf("jitter was %s, want about 10ms", stats.Jitter)
+	}
+
+	// A steady round trip lets it settle back down
+	for i := 0; i < 100; i++ {
+		pong(link, 260*time.Millisecond)
+	}
+	if stats := link.Stats(); stats.Jitter > 2*time.Millisecond {
+		t.Fatalf("jitter was %s after a steady round trip, want it near 0", stats.Jitter)
+	}
+
+	// Answers that don't carry a send time are ignored
+	link.Pong(&ControlProtocol{Type: PONG})
+	if link.Stats().RTT < 260*time.Millisecond {
+		t.Fatal("an empty pong changed the round trip")
+	}
+}
@@ -9,7 +9,7 @@ import (
 
 // Joysticks and triggers behave fairly differently
 var (
-	JOYSTICK_AXES = [4]glfw.GamepadAxis{glfw.AxisLeftX, glfw.AxisLeftY, glfw.AxisRightX, glfw.AxisLeftY}
+	JOYSTICK_AXES = [4]glfw.GamepadAxis{glfw.AxisLeftX, glfw.AxisLeftY, glfw.AxisRightX, glfw.AxisRightY}
 	TRIGGER_AXES  = [2]glfw.GamepadAxis{glfw.AxisLeftTrigger, glfw.AxisRightTrigger}
 )
 
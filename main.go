@@ -2,17 +2,13 @@ package main
 
 import (
 	"log"
+	"os"
 	"runtime"
-	"sync"
 	"time"
 
 	"github.com/go-gl/glfw/v3.3/glfw"
-	"github.com/go-vgo/robotgo"
 )
 
-var gamepadStates map[glfw.Joystick]glfw.GamepadState = make(map[glfw.Joystick]glfw.GamepadState)
-var gamestateLock *sync.RWMutex = &sync.RWMutex{}
-
 func main() {
 	runtime.LockOSThread()
 	err := glfw.Init()
@@ -24,115 +20,156 @@ func main() {
 	// Read command line args
 	cli := argParse()
 
+	// Only look for mistakes in the config
+	if cli.Check {
+		_, err := loadConfig(cli.Config)
+		if err != nil {
+			logConfigError(err)
+			os.Exit(1)
+		}
+		log.Println("The config is valid")
+		return
+	}
+
 	// Initialize the joystick handlers
 	joysticks := joysticksInit()
 
-	// Virtual Gamepad
-	var multiplexed glfw.GamepadState
-	// TODO Next line not needed once we call `multiplex`
-	multiplexed.Axes = [6]float32{0, 0, 0, 0, -1, -1}
-
 	if cli.Listen {
 		// Read in the configs
-		rules, buttonMap, axisMap := readConfig(cli.Config)
+		config, err := loadConfig(cli.Config)
+		if err != nil {
+			logConfigError(err)
+			os.Exit(1)
+		}
 
-		// Run the server to listen for joystick inputs
-		go listen(cli.Domain, cli.Port, rules)
+		// Start with the profile from the command line or the config
+		profile := config.Profile
+		if cli.Profile != "" {
+			profile = cli.Profile
+		}
+		if _, exists := config.Profiles[profile]; !exists {
+			log.Fatalf("CONFIG ERROR: no profile named %s\n", profile)
+		}
 
-		for {
-			// glfw.PollEvents()
-			multiplexTrust(gamepadStates, &multiplexed)
-			if cli.Verbose {
-				log.Println(multiplexed)
-			}
+		// Open wherever the virtual gamepad goes
+		output, err := newOutput(cli, config.Profiles[profile].Mapping)
+		if err != nil {
+			log.Fatalln("Failed to open the output due to error:", err)
+		}
+		defer output.Close()
 
-			// Button events
-			for i := 0; i < len(multiplexed.Buttons); i++ {
-				button := glfw.GamepadButton(i)
-				if rule, exists := buttonMap[button]; exists {
-					if multiplexed.Buttons[button] == glfw.Press {
-						robotgo.KeyDown(rule.Key0)
-					} else {
-						robotgo.KeyUp(rule.Key0)
-					}
-				}
-			}
+		// Pass the game's rumble on to everyone
+		if rumbler, ok := output.(RumbleOutput); ok {
+			rumbler.HandleRumble(broadcastRumble)
+		}
 
-			// Joystick events
-			for _, axis := range JOYSTICK_AXES {
-				if rule, exists := axisMap[axis]; exists {
-					if multiplexed.Axes[axis] > 0 {
-						// positives "right or down"
-						robotgo.KeyUp(rule.Key0)
-						robotgo.KeyDown(rule.Key1)
-					} else if multiplexed.Axes[axis] < 0 {
-						// negatives "left or up"
-						robotgo.KeyDown(rule.Key0)
-						robotgo.KeyUp(rule.Key1)
-					} else {
-						// zero "nothing"
-						robotgo.KeyUp(rule.Key0)
-						robotgo.KeyUp(rule.Key1)
-					}
-				}
-			}
+		// Everything that can change the virtual gamepad goes through the core,
+		// it fills in how axes are shaped from the profile being played
+		responses := make(ClientResponses)
+		core := newCore(nil, output, cli.Timeout, cli.Evict)
+		core.Verbose = cli.Verbose
+		core.Profiles = config.Profiles
+		core.ProfileChord = config.ProfileChord
+		core.Responses = responses
+		err = core.SetProfile(profile)
+		if err != nil {
+			log.Fatalln("CONFIG ERROR:", err)
+		}
 
-			// Trigger events
-			for _, axis := range TRIGGER_AXES {
-				if rule, exists := axisMap[axis]; exists {
-					if multiplexed.Axes[axis] != -1 {
-						robotgo.KeyDown(rule.Key0)
-					} else {
-						robotgo.KeyUp(rule.Key0)
-					}
-				}
-			}
+		// Run the server to listen for joystick inputs
+		go listen(cli.Domain, cli.Port, config.Rules, responses, cli.Security(), cli.Grace)
+
+		// Take commands from whoever is running the server
+		go adminConsole(os.Stdin, events)
+		// Pick up changes to the config without kicking anyone
+		go watchConfig(cli.Config, config.Rules)
+		if cli.API != "" {
+			go serveAPI(cli.API, cli.APIToken, config.Rules)
+		}
 
-			time.Sleep(Interval)
+		err = core.Run(events)
+		if err != nil {
+			log.Fatalln("Failed to output the gamepad due to error:", err)
 		}
 	} else {
 		// Connect to the server
-		conn := connect(cli.Domain, cli.Port, cli.Name)
+		conn := connect(cli.Domain, cli.Port, cli.Name, cli.Security())
+
+		// Play rumble from the server on our joysticks
+		haptics, err := newHaptics(cli)
+		if err != nil {
+			log.Fatalln("Failed to open the haptics due to error:", err)
+		}
+		defer haptics.Close()
+
+		// Listen for messages from the server
+		go conn.ControlListener()
+
+		// Each joystick decides on its own when it has something to send
+		var senders [len(joysticks)]GamestateSender
+		for i := range senders {
+			senders[i] = GamestateSender{Tick: cli.Tick(), Keepalive: cli.Keepalive}
+		}
+		// Which joysticks were plugged in last time they were looked at
+		var present [len(joysticks)]bool
 
-		// Create a counter
-		count := 1
 		for {
 			glfw.PollEvents()
-			// Get joystick states
-			for i, joy := range joysticks {
-				if joy.Present() {
-					// Is this the best place to put the locks?
-					gamestateLock.Lock()
-					gamepadStates[glfw.Joystick(i)] = *joy.GetGamepadState()
-					log.Println(gamepadStates[joy])
-					gamestateLock.Unlock()
+
+			// Joysticks can only be touched from the main thread
+			for rumbling := true; rumbling; {
+				select {
+				case cmd := <-conn.Rumbles:
+					playRumble(haptics, joysticks, cmd)
+				default:
+					rumbling = false
 				}
 			}
-			// Multiplex the states
-			multiplex(conn.Rules, gamepadStates, &multiplexed)
-			if cli.Verbose {
-				log.Println(multiplexed)
-			}
 
-			// Create the multiplexed packet
-			pkt := GamestateProtocol{
-				PacketId:     uint32(count),
-				JoystickId:   conn.Id,
-				GamepadState: multiplexed,
-			}
-			// Update the packet count
-			count++
+			now := time.Now()
+			// Send the raw state of every joystick, the server applies the
+			// rules. Unplugged joysticks stop sending and the server lets go
+			// of them once they time out
+			for i, joy := range joysticks {
+				if !joy.Present() {
+					if present[i] {
+						present[i] = false
+						senders[i].Reset()
+						conn.SetPeripheral(uint8(i), nil)
+					}
+					continue
+				}
 
-			// Send the packet to the server
-			go func() {
-				_, err := conn.DatagramConn.Write(pkt.Bytes())
+				// Let the server know which controller this is when it's
+				// plugged in, rules can pick it by name or GUID
+				if !present[i] {
+					present[i] = true
+					conn.SetPeripheral(uint8(i), &Peripheral{uint8(i), joy.GetGUID(), joy.GetGamepadName()})
+				}
+
+				state := *joy.GetGamepadState()
+				if !senders[i].ShouldSend(state, now) {
+					continue
+				}
+				if cli.Verbose {
+					log.Println(i, state)
+				}
+
+				pkt := GamestateProtocol{
+					DeviceId:     uint8(i),
+					GamepadState: state,
+				}
+
+				// Send the packet to the server, the control listener
+				// reconnects if the server went away
+				err := conn.SendGamestate(pkt)
 				if err != nil {
-					log.Fatalln("Failed to send packet due to error:", err)
+					log.Println("Failed to send packet due to error:", err)
 				}
-			}()
+			}
 
 			// Wait until trying again
-			time.Sleep(Interval)
+			time.Sleep(POLL_INTERVAL)
 		}
 	}
 }
@@ -1,11 +1,93 @@
 package main
 
 import (
+	"fmt"
+	"sort"
+
 	"github.com/go-gl/glfw/v3.3/glfw"
 )
 
-const STICK_DEADZONE float32 = 0.20
-const TRIGGER_DEADZONE float32 = 0.40
+// InputId names a physical joystick, Device is the joystick's index on the
+// machine of the client it's plugged into
+type InputId struct {
+	Client uint8
+	Device glfw.Joystick
+}
+
+// StatesMap holds the latest state of every joystick
+type StatesMap map[InputId]glfw.GamepadState
+
+// InputRules holds which buttons and axes each joystick is allowed to use
+type InputRules map[InputId][]MultiplexRule
+
+// Multiplexer merges the states of many gamepads into a single virtual gamepad.
+// Only the buttons and axes a joystick has a rule for are considered, nil
+// InputRules trusts every joystick with every input.
+type Multiplexer interface {
+	Multiplex(rules InputRules, states StatesMap, multiplexed *glfw.GamepadState)
+}
+
+// Names of the multiplexers that can be picked from the config
+const (
+	MULTIPLEX_AVERAGE   = "average"
+	MULTIPLEX_OR        = "or"
+	MULTIPLEX_VOTE      = "vote"
+	MULTIPLEX_STRONGEST = "strongest"
+	MULTIPLEX_FIRST     = "first"
+	MULTIPLEX_TURNS     = "turns"
+)
+
+// The fraction of voters needed to press a button when none is configured
+const DEFAULT_QUORUM float32 = 0.5
+
+// newMultiplexer creates the multiplexer described by the config
+func newMultiplexer(config MultiplexerConfig) (Multiplexer, error) {
+	switch config.Mode {
+	case "", MULTIPLEX_AVERAGE:
+		return AverageMultiplexer{}, nil
+	case MULTIPLEX_OR:
+		return OrMultiplexer{}, nil
+	case MULTIPLEX_VOTE:
+		quorum := DEFAULT_QUORUM
+		if config.Quorum != nil {
+			quorum = *config.Quorum
+		}
+		if quorum < 0 || quorum > 1 {
+			return nil, fmt.Errorf("quorum %g must be between 0 and 1", quorum)
+		}
+		return VoteMultiplexer{quorum}, nil
+	case MULTIPLEX_STRONGEST:
+		return StrongestMultiplexer{}, nil
+	case MULTIPLEX_FIRST:
+		return &FirstMultiplexer{}, nil
+	case MULTIPLEX_TURNS:
+		chord := make([]glfw.GamepadButton, len(config.TurnChord))
+		for i, input := range config.TurnChord {
+			rule, err := parseRule(input)
+			if err != nil {
+				return nil, err
+			}
+			if rule.Type != Button {
+				return nil, fmt.Errorf("turn chord can only use buttons, got %s", input)
+			}
+			chord[i] = rule.Button
+		}
+		return newTurnMultiplexer(config.TurnLength, chord), nil
+	}
+
+	return nil, fmt.Errorf("unknown multiplexer %s", config.Mode)
+}
+
+// Every rule a joystick can have, used when the joysticks are trusted
+var allRules = func() (rules []MultiplexRule) {
+	for button := glfw.ButtonA; button <= glfw.ButtonLast; button++ {
+		rules = append(rules, MultiplexRule{Button, button, 0})
+	}
+	for axis := glfw.AxisLeftX; axis <= glfw.AxisLast; axis++ {
+		rules = append(rules, MultiplexRule{Axis, 0, axis})
+	}
+	return rules
+}()
 
 func abs32(f float32) float32 {
 	if f < 0 {
@@ -15,124 +97,294 @@ func abs32(f float32) float32 {
 	}
 }
 
-func multiplexTrust(states map[glfw.Joystick]glfw.GamepadState, multiplexed *glfw.GamepadState) {
-	// totals to calculate average
-	axesUsed := []float32{0, 0, 0, 0, 0, 0}
-	multiplexed.Axes = [6]float32{0, 0, 0, 0, 0, 0}
+func clamp32(f, min, max float32) float32 {
+	if f < min {
+		return min
+	} else if f > max {
+		return max
+	} else {
+		return f
+	}
+}
+
+func isTrigger(axis glfw.GamepadAxis) bool {
+	return axis == glfw.AxisLeftTrigger || axis == glfw.AxisRightTrigger
+}
+
+// restValue is where an axis sits when nobody touches it
+func restValue(axis glfw.GamepadAxis) float32 {
+	if isTrigger(axis) {
+		// Triggers rest at -1
+		return -1
+	}
+	// Joysticks rest at 0
+	return 0
+}
+
+// deflected checks if an axis has been moved past its deadzone. Shaping put
+// everything inside the deadzone back at rest, so that's any move from rest
+func deflected(axis glfw.GamepadAxis, value float32) bool {
+	return value != restValue(axis)
+}
+
+// rest puts the virtual gamepad into a state where nothing is pressed
+func rest(multiplexed *glfw.GamepadState) {
 	multiplexed.Buttons = [15]glfw.Action{glfw.Release}
+	for axis := range multiplexed.Axes {
+		multiplexed.Axes[axis] = restValue(glfw.GamepadAxis(axis))
+	}
+}
 
-	gamestateLock.RLock()
-	for _, state := range states {
-		for i := 0; i < len(multiplexed.Buttons); i++ {
-			multiplexed.Buttons[i] |= state.Buttons[i]
+// resting is a gamepad nobody is touching
+var resting = func() (state glfw.GamepadState) {
+	rest(&state)
+	return state
+}()
+
+// mask returns the state with every button and axis the rules don't allow
+// put back at rest, so a joystick can only touch what it was given
+func mask(state glfw.GamepadState, rules []MultiplexRule) glfw.GamepadState {
+	masked := resting
+	for _, rule := range rules {
+		switch rule.Type {
+		case Button:
+			masked.Buttons[rule.Button] = state.Buttons[rule.Button]
+		case Axis:
+			masked.Axes[rule.Axis] = state.Axes[rule.Axis]
 		}
+	}
+	return masked
+}
 
-		// Joysticks are centered at 0
-		for _, axis := range JOYSTICK_AXES {
-			// Joysticks rest at 0
-			if abs32(state.Axes[axis]) > STICK_DEADZONE {
-				multiplexed.Axes[axis] += state.Axes[axis]
-				axesUsed[axis] += 1
-			}
+// joystickRules returns the rules a joystick is allowed to use
+func joystickRules(rules InputRules, id InputId) []MultiplexRule {
+	if rules == nil {
+		return allRules
+	}
+	return rules[id]
+}
+
+// forEachInput calls fn with every input a joystick is allowed to use.
+// Joysticks are visited in order of their id so ties are broken consistently
+func forEachInput(
+	rules InputRules,
+	states StatesMap,
+	fn func(id InputId, state *glfw.GamepadState, rule MultiplexRule),
+) {
+	for _, id := range sortedInputs(states) {
+		state := states[id]
+		for _, rule := range joystickRules(rules, id) {
+			fn(id, &state, rule)
 		}
+	}
+}
 
-		// Triggers are centered at -1
-		for _, axis := range TRIGGER_AXES {
-			// Triggers rest at -1
-			if state.Axes[axis] > -1+TRIGGER_DEADZONE {
-				multiplexed.Axes[axis] += state.Axes[axis]
-			} else {
-				multiplexed.Axes[axis] += -1
+// sortedInputs lists the joysticks in order of client then device
+func sortedInputs(states StatesMap) []InputId {
+	ids := make([]InputId, 0, len(states))
+	for id := range states {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if ids[i].Client != ids[j].Client {
+			return ids[i].Client < ids[j].Client
+		}
+		return ids[i].Device < ids[j].Device
+	})
+	return ids
+}
+
+// AverageMultiplexer presses a button if anyone is pressing it, sticks get put
+// through a deadzone filter then averaged. This way if player 1 and player 2
+// are moving opposite they will cancel, however player 1 not moving and
+// player 2 moving won't result in half speed. Triggers are averaged over
+// everyone, with the ones inside their deadzone counting as released
+type AverageMultiplexer struct{}
+
+func (AverageMultiplexer) Multiplex(
+	rules InputRules,
+	states StatesMap,
+	multiplexed *glfw.GamepadState,
+) {
+	// totals to calculate average
+	var axesTotal, axesUsed [6]float32
+	rest(multiplexed)
+
+	forEachInput(rules, states, func(id InputId, state *glfw.GamepadState, rule MultiplexRule) {
+		switch rule.Type {
+		case Button:
+			// If anyone is pressing the button, then it is pressed
+			multiplexed.Buttons[rule.Button] |= state.Buttons[rule.Button]
+		case Axis:
+			value := state.Axes[rule.Axis]
+			if !deflected(rule.Axis, value) {
+				if !isTrigger(rule.Axis) {
+					return
+				}
+				value = restValue(rule.Axis)
 			}
-			axesUsed[axis] += 1
+			axesTotal[rule.Axis] += value
+			axesUsed[rule.Axis] += 1
 		}
-	}
-	gamestateLock.RUnlock()
+	})
 
-	// Joysticks are centered at 0
-	for _, axis := range JOYSTICK_AXES {
-		if axesUsed[axis] == 0 {
-			multiplexed.Axes[axis] = 0
-		} else {
+	for axis := range multiplexed.Axes {
+		if axesUsed[axis] != 0 {
 			// Average all the inputs from controllers
-			multiplexed.Axes[axis] = multiplexed.Axes[axis] / axesUsed[axis]
+			multiplexed.Axes[axis] = axesTotal[axis] / axesUsed[axis]
 		}
 	}
+}
 
-	// Triggers are centered at -1
-	for _, axis := range TRIGGER_AXES {
-		if axesUsed[axis] == 0 {
-			multiplexed.Axes[axis] = -1
-		} else {
-			// Average all the inputs from controllers
-			multiplexed.Axes[axis] = multiplexed.Axes[axis] / axesUsed[axis]
+// OrMultiplexer presses a button if anyone is pressing it and adds together
+// every deflected axis, so players pushing the same way move faster
+type OrMultiplexer struct{}
+
+func (OrMultiplexer) Multiplex(
+	rules InputRules,
+	states StatesMap,
+	multiplexed *glfw.GamepadState,
+) {
+	rest(multiplexed)
+
+	forEachInput(rules, states, func(id InputId, state *glfw.GamepadState, rule MultiplexRule) {
+		switch rule.Type {
+		case Button:
+			multiplexed.Buttons[rule.Button] |= state.Buttons[rule.Button]
+		case Axis:
+			if deflected(rule.Axis, state.Axes[rule.Axis]) {
+				// Add how far the axis moved from rest
+				multiplexed.Axes[rule.Axis] += state.Axes[rule.Axis] - restValue(rule.Axis)
+			}
 		}
+	})
+
+	for axis := range multiplexed.Axes {
+		multiplexed.Axes[axis] = clamp32(multiplexed.Axes[axis], -1, 1)
 	}
 }
 
-func multiplex(
-	rules RulesMap,
-	states map[glfw.Joystick]glfw.GamepadState,
+// VoteMultiplexer presses a button only when at least Quorum of the players
+// with a rule for that button press it at once, axes are averaged like the
+// AverageMultiplexer. Players that don't own a button don't get a vote, and a
+// player with several joysticks only gets one, which is for if any of them press it
+type VoteMultiplexer struct {
+	Quorum float32
+}
+
+func (m VoteMultiplexer) Multiplex(
+	rules InputRules,
+	states StatesMap,
 	multiplexed *glfw.GamepadState,
 ) {
-	// totals to calculate average
-	axesUsed := []float32{0, 0, 0, 0, 0, 0}
-	multiplexed.Axes = [6]float32{0, 0, 0, 0, 0, 0}
+	// Average the axes and throw away the buttons
+	AverageMultiplexer{}.Multiplex(rules, states, multiplexed)
 	multiplexed.Buttons = [15]glfw.Action{glfw.Release}
 
-	gamestateLock.RLock()
-	for id, state := range states {
-		if rules[id] == nil {
-			continue
-		}
-
-		// Apply rules
-		for _, rule := range rules[id] {
-			switch rule.Type {
-			case Button:
-				// If anyone is pressing the button, then it is pressed
-				multiplexed.Buttons[rule.Button] |= state.Buttons[rule.Button]
-			case Axis:
-				// Axes get put through a deadzone filter then averaged
-				// This way if player 1 and player are moving opposite they will cancel
-				// However player 1 not moving and player 2 moving won't result in half speed
-				if rule.Axis == glfw.AxisLeftTrigger || rule.Axis == glfw.AxisRightTrigger {
-					// Triggers rest at -1
-					if state.Axes[rule.Axis] > -1+TRIGGER_DEADZONE {
-						multiplexed.Axes[rule.Axis] += state.Axes[rule.Axis]
-					} else {
-						multiplexed.Axes[rule.Axis] += -1
-					}
-					axesUsed[rule.Axis] += 1
-				} else {
-					// Joysticks rest at 0
-					if abs32(state.Axes[rule.Axis]) > STICK_DEADZONE {
-						multiplexed.Axes[rule.Axis] += state.Axes[rule.Axis]
-						axesUsed[rule.Axis] += 1
-					}
-				}
+	// Which players own each button, and whether they're pressing it
+	var voters [15]map[uint8]bool
+	forEachInput(rules, states, func(id InputId, state *glfw.GamepadState, rule MultiplexRule) {
+		if rule.Type != Button {
+			return
+		}
+		if voters[rule.Button] == nil {
+			voters[rule.Button] = make(map[uint8]bool)
+		}
+		voters[rule.Button][id.Client] = voters[rule.Button][id.Client] ||
+			state.Buttons[rule.Button] == glfw.Press
+	})
+
+	for button, players := range voters {
+		var votes float32
+		for _, pressed := range players {
+			if pressed {
+				votes++
 			}
 		}
+		if votes > 0 && votes >= m.Quorum*float32(len(players)) {
+			multiplexed.Buttons[button] = glfw.Press
+		}
 	}
-	gamestateLock.RUnlock()
+}
 
-	// Joysticks are centered at 0
-	for _, axis := range JOYSTICK_AXES {
-		if axesUsed[axis] == 0 {
-			multiplexed.Axes[axis] = 0
-		} else {
-			// Average all the inputs from controllers
-			multiplexed.Axes[axis] = multiplexed.Axes[axis] / axesUsed[axis]
+// StrongestMultiplexer presses a button if anyone is pressing it, each axis
+// follows whichever joystick pushes it the furthest from rest
+type StrongestMultiplexer struct{}
+
+func (StrongestMultiplexer) Multiplex(
+	rules InputRules,
+	states StatesMap,
+	multiplexed *glfw.GamepadState,
+) {
+	rest(multiplexed)
+
+	forEachInput(rules, states, func(id InputId, state *glfw.GamepadState, rule MultiplexRule) {
+		switch rule.Type {
+		case Button:
+			multiplexed.Buttons[rule.Button] |= state.Buttons[rule.Button]
+		case Axis:
+			value := state.Axes[rule.Axis]
+			strongest := multiplexed.Axes[rule.Axis]
+			if deflected(rule.Axis, value) &&
+				abs32(value-restValue(rule.Axis)) > abs32(strongest-restValue(rule.Axis)) {
+				multiplexed.Axes[rule.Axis] = value
+			}
 		}
+	})
+}
+
+// FirstMultiplexer gives each button and axis to the first joystick that
+// uses it. Nobody else can touch that input until the claimant lets go of it
+type FirstMultiplexer struct {
+	buttonOwners map[glfw.GamepadButton]InputId
+	axisOwners   map[glfw.GamepadAxis]InputId
+}
+
+func (m *FirstMultiplexer) Multiplex(
+	rules InputRules,
+	states StatesMap,
+	multiplexed *glfw.GamepadState,
+) {
+	if m.buttonOwners == nil {
+		m.buttonOwners = make(map[glfw.GamepadButton]InputId)
+		m.axisOwners = make(map[glfw.GamepadAxis]InputId)
 	}
+	rest(multiplexed)
 
-	// Triggers are centered at -1
-	for _, axis := range TRIGGER_AXES {
-		if axesUsed[axis] == 0 {
-			multiplexed.Axes[axis] = -1
-		} else {
-			// Average all the inputs from controllers
-			multiplexed.Axes[axis] = multiplexed.Axes[axis] / axesUsed[axis]
+	// Release the claims of joysticks that stopped using an input or went away
+	for button, id := range m.buttonOwners {
+		state, exists := states[id]
+		if !exists || state.Buttons[button] != glfw.Press {
+			delete(m.buttonOwners, button)
 		}
 	}
+	for axis, id := range m.axisOwners {
+		state, exists := states[id]
+		if !exists || !deflected(axis, state.Axes[axis]) {
+			delete(m.axisOwners, axis)
+		}
+	}
+
+	forEachInput(rules, states, func(id InputId, state *glfw.GamepadState, rule MultiplexRule) {
+		switch rule.Type {
+		case Button:
+			owner, claimed := m.buttonOwners[rule.Button]
+			if !claimed && state.Buttons[rule.Button] == glfw.Press {
+				m.buttonOwners[rule.Button] = id
+				owner, claimed = id, true
+			}
+			if claimed && owner == id {
+				multiplexed.Buttons[rule.Button] = state.Buttons[rule.Button]
+			}
+		case Axis:
+			owner, claimed := m.axisOwners[rule.Axis]
+			if !claimed && deflected(rule.Axis, state.Axes[rule.Axis]) {
+				m.axisOwners[rule.Axis] = id
+				owner, claimed = id, true
+			}
+			if claimed && owner == id {
+				multiplexed.Axes[rule.Axis] = state.Axes[rule.Axis]
+			}
+		}
+	})
 }
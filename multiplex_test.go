@@ -0,0 +1,160 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-gl/glfw/v3.3/glfw"
+)
+
+// gamepad is a resting gamepad with the buttons pressed
+func gamepad(buttons ...glfw.GamepadButton) glfw.GamepadState {
+	state := resting
+	for _, button := range buttons {
+		state.Buttons[button] = glfw.Press
+	}
+	return state
+}
+
+// with is the gamepad with one axis moved
+func with(state glfw.GamepadState, axis glfw.GamepadAxis, value float32) glfw.GamepadState {
+	state.Axes[axis] = value
+	return state
+}
+
+// sameGamepad checks two gamepads press the same buttons and move the axes
+// the same give or take rounding
+func sameGamepad(a, b glfw.GamepadState) bool {
+	if a.Buttons != b.Buttons {
+		return false
+	}
+	for axis := range a.Axes {
+		if !near(a.Axes[axis], b.Axes[axis]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMultiplexers(t *testing.T) {
+	alice, alice2, bob, carol := InputId{1, 0}, InputId{1, 1}, InputId{2, 0}, InputId{3, 0}
+	everyone := InputRules{alice: allRules, alice2: allRules, bob: allRules, carol: allRules}
+	buttonA := []MultiplexRule{{Button, glfw.ButtonA, 0}}
+	lx, rt := glfw.AxisLeftX, glfw.AxisRightTrigger
+
+	tests := []struct {
+		name        string
+		multiplexer Multiplexer
+		rules       InputRules
+		states      StatesMap
+		want        glfw.GamepadState
+	}{
+		{"or presses what anyone presses", OrMultiplexer{}, everyone,
+			StatesMap{alice: gamepad(glfw.ButtonA), bob: gamepad(glfw.ButtonB)},
+			gamepad(glfw.ButtonA, glfw.ButtonB)},
+		{"or adds axes", OrMultiplexer{}, everyone,
+			StatesMap{alice: with(resting, lx, 0.3), bob: with(resting, lx, 0.4)},
+			with(resting, lx, 0.7)},
+		{"or cancels opposite axes", OrMultiplexer{}, everyone,
+			StatesMap{alice: with(resting, lx, 0.5), bob: with(resting, lx, -0.5)},
+			resting},
+		{"or stops at the edge", OrMultiplexer{}, everyone,
+			StatesMap{alice: with(resting, lx, 0.8), bob: with(resting, lx, 0.6)},
+			with(resting, lx, 1)},
+		{"or adds triggers from rest", OrMultiplexer{}, everyone,
+			StatesMap{alice: with(resting, rt, -0.5), bob: with(resting, rt, -0.5), carol: resting},
+			with(resting, rt, 0)},
+		{"or ignores what a joystick doesn't own", OrMultiplexer{}, InputRules{alice: buttonA, bob: buttonA},
+			StatesMap{alice: gamepad(glfw.ButtonB), bob: with(resting, lx, 1)},
+			resting},
+
+		{"vote without a quorum", VoteMultiplexer{0.5}, everyone,
+			StatesMap{alice: gamepad(glfw.ButtonA), bob: resting, carol: resting},
+			resting},
+		{"vote with a quorum", VoteMultiplexer{0.5}, everyone,
+			StatesMap{alice: gamepad(glfw.ButtonA), bob: gamepad(glfw.ButtonA), carol: resting},
+			gamepad(glfw.ButtonA)},
+		{"vote on the quorum", VoteMultiplexer{0.5}, everyone,
+			StatesMap{alice: gamepad(glfw.ButtonA), bob: resting},
+			gamepad(glfw.ButtonA)},
+		{"vote with one joystick of a player", VoteMultiplexer{0.5}, everyone,
+			StatesMap{alice: resting, alice2: gamepad(glfw.ButtonA), bob: gamepad(glfw.ButtonA), carol: resting},
+			gamepad(glfw.ButtonA)},
+		{"vote counts a player once", VoteMultiplexer{0.5}, everyone,
+			StatesMap{alice: gamepad(glfw.ButtonA), alice2: gamepad(glfw.ButtonA), bob: resting, carol: resting},
+			resting},
+		{"vote only counts players owning the button", VoteMultiplexer{0.5}, InputRules{alice: buttonA, bob: buttonA, carol: nil},
+			StatesMap{alice: gamepad(glfw.ButtonA), bob: resting, carol: gamepad(glfw.ButtonA)},
+			gamepad(glfw.ButtonA)},
+		{"vote needs everyone with a quorum of 1", VoteMultiplexer{1}, everyone,
+			StatesMap{alice: gamepad(glfw.ButtonA), bob: gamepad(glfw.ButtonA), carol: resting},
+			resting},
+		{"vote needs a press with a quorum of 0", VoteMultiplexer{0}, everyone,
+			StatesMap{alice: resting, bob: resting},
+			resting},
+		{"vote averages axes", VoteMultiplexer{0.5}, everyone,
+			StatesMap{alice: with(resting, lx, 0.4), bob: with(resting, lx, 0.8), carol: resting},
+			with(resting, lx, 0.6)},
+
+		{"strongest presses what anyone presses", StrongestMultiplexer{}, everyone,
+			StatesMap{alice: gamepad(glfw.ButtonA), bob: gamepad(glfw.ButtonB)},
+			gamepad(glfw.ButtonA, glfw.ButtonB)},
+		{"strongest follows the furthest stick", StrongestMultiplexer{}, everyone,
+			StatesMap{alice: with(resting, lx, 0.3), bob: with(resting, lx, -0.7)},
+			with(resting, lx, -0.7)},
+		{"strongest follows the furthest trigger", StrongestMultiplexer{}, everyone,
+			StatesMap{alice: with(resting, rt, 0.5), bob: with(resting, rt, -0.2)},
+			with(resting, rt, 0.5)},
+		{"strongest ignores what a joystick doesn't own", StrongestMultiplexer{}, InputRules{alice: buttonA, bob: allRules},
+			StatesMap{alice: with(resting, lx, 1), bob: with(resting, lx, 0.3)},
+			with(resting, lx, 0.3)},
+
+		{"first gives an input to whoever uses it", &FirstMultiplexer{}, everyone,
+			StatesMap{alice: with(gamepad(glfw.ButtonA), lx, 0.5), bob: resting},
+			with(gamepad(glfw.ButtonA), lx, 0.5)},
+		{"first goes in order of id when pressed together", &FirstMultiplexer{}, everyone,
+			StatesMap{alice: with(resting, lx, 0.5), bob: with(resting, lx, -0.9)},
+			with(resting, lx, 0.5)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var multiplexed glfw.GamepadState
+			test.multiplexer.Multiplex(test.rules, test.states, &multiplexed)
+			if !sameGamepad(multiplexed, test.want) {
+				t.Fatalf("multiplexed into %v, want %v", multiplexed, test.want)
+			}
+		})
+	}
+}
+
+func TestFirstMultiplexer(t *testing.T) {
+	alice, bob := InputId{1, 0}, InputId{2, 0}
+	lx := glfw.AxisLeftX
+	m := &FirstMultiplexer{}
+
+	steps := []struct {
+		name   string
+		states StatesMap
+		want   glfw.GamepadState
+	}{
+		{"alice claims", StatesMap{alice: with(gamepad(glfw.ButtonA), lx, 0.5), bob: resting},
+			with(gamepad(glfw.ButtonA), lx, 0.5)},
+		{"bob can't take them", StatesMap{alice: with(gamepad(glfw.ButtonA), lx, 0.5), bob: with(gamepad(glfw.ButtonA), lx, -0.9)},
+			with(gamepad(glfw.ButtonA), lx, 0.5)},
+		{"alice lets go", StatesMap{alice: resting, bob: with(gamepad(glfw.ButtonA), lx, -0.9)},
+			with(gamepad(glfw.ButtonA), lx, -0.9)},
+		{"alice can't take them back", StatesMap{alice: with(gamepad(glfw.ButtonA), lx, 0.5), bob: with(gamepad(glfw.ButtonA), lx, -0.9)},
+			with(gamepad(glfw.ButtonA), lx, -0.9)},
+		{"bob leaves", StatesMap{alice: with(gamepad(glfw.ButtonA), lx, 0.5)},
+			with(gamepad(glfw.ButtonA), lx, 0.5)},
+		{"alice lets go too", StatesMap{alice: resting},
+			resting},
+	}
+	for _, s := range steps {
+		var multiplexed glfw.GamepadState
+		m.Multiplex(nil, s.states, &multiplexed)
+		if !sameGamepad(multiplexed, s.want) {
+			t.Fatalf("%s: multiplexed into %v, want %v", s.name, multiplexed, s.want)
+		}
+	}
+}
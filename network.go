@@ -1,8 +1,11 @@
 package main
 
 import (
+	"crypto/cipher"
+	"crypto/rand"
 	"net"
 	"sync"
+	"time"
 )
 
 var clients map[uint8]*ServerConn = make(map[uint8]*ServerConn)
@@ -12,15 +15,98 @@ var clientLock *sync.Mutex = &sync.Mutex{}
 
 type ClientConn struct {
 	Id           uint8
+	Host         string
+	Port         uint16
 	Name         string
-	ControlConn  net.Conn
+	Version      uint8
+	Capabilities uint32
+	Token        SessionToken
+	Security     Security
+	ControlConn  *ControlStream
 	DatagramConn net.Conn
 	Rules        RulesMap
+
+	// Hands our id and rules back to us if the connection drops
+	ResumeToken SessionToken
+	// Rumble the server asked for, played by the main thread
+	Rumbles chan RumbleCommand
+	// How healthy the connection to the server is
+	Link Link
+
+	// Seals gamestate packets once keys have been exchanged
+	datagramCipher cipher.AEAD
+	// What was offered and agreed to in the handshake, bound into the keys
+	negotiation Negotiation
+	// Id of the last gamestate packet sent
+	packetId uint32
+	// What each joystick last sent when compressing
+	encoders map[uint8]*DeltaEncoder
+	// Controllers plugged in, sent again after reconnecting
+	peripherals map[uint8]Peripheral
+
+	// Whether the session is up, nothing is sent while reconnecting
+	connected bool
+	// Held while dialing so nothing is sent over a half made session
+	lock sync.Mutex
 }
 
 type ServerConn struct {
-	Id    uint8
-	Name  string
-	Conn  net.Conn
-	Rules ClientsMap
+	Id           uint8
+	Name         string
+	Version      uint8
+	Capabilities uint32
+	Token        SessionToken
+	Conn         *ControlStream
+	DatagramAddr net.Addr
+	Rules        ClientsMap
+	Responses    ClientResponses
+	Security     Security
+	// How long the client's id is held for it after the control socket drops
+	Grace time.Duration
+
+	// Ready is set once the handshake is done and the client can take part
+	Ready bool
+	// held is set while the client is gone but can still resume its session
+	held        bool
+	resumeToken SessionToken
+	// Opens gamestate packets once keys have been exchanged
+	datagramCipher cipher.AEAD
+	// What was offered and agreed to in the handshake, bound into the keys
+	negotiation Negotiation
+
+	// Id of the newest gamestate packet and the keyframes compressed packets
+	// build on, only used by the UDP listener
+	lastPacketId uint32
+	deltas       DeltaDecoder
+	// How healthy the connection to the client is
+	Link Link
+
+	// Controllers the client has plugged in, and the rules of each joystick
+	// worked out from them. Both are guarded by clientLock
+	peripherals map[uint8]Peripheral
+	resolved    RulesMap
+}
+
+// RumbleCommand is a rumble the server asked a client to play
+type RumbleCommand struct {
+	Joystick uint8
+	Effect   Rumble
+}
+
+// Security is how a connection gets protected
+type Security struct {
+	// Passphrase both sides mix into the encryption keys, so only people who
+	// know it can sit in the middle of the key exchange
+	Secret []byte
+	// Refuse to talk to a peer that can't encrypt
+	Required bool
+}
+
+// SessionToken ties the gamestate packets of a client to its control socket
+type SessionToken [8]byte
+
+// newToken creates a random session token
+func newToken() (token SessionToken, err error) {
+	_, err = rand.Read(token[:])
+	return token, err
 }
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/go-gl/glfw/v3.3/glfw"
+	"github.com/go-vgo/robotgo"
+)
+
+// Output turns the multiplexed gamepad into something the game can see
+type Output interface {
+	Emit(state *glfw.GamepadState) error
+	Close() error
+}
+
+// RumbleOutput is an output the game can send force feedback back through
+type RumbleOutput interface {
+	Output
+	HandleRumble(handler func(Rumble))
+}
+
+// MappingOutput is an output that follows the mapping section of the config
+type MappingOutput interface {
+	Output
+	SetMapping(mapping Mapping)
+}
+
+// Names of the outputs that can be picked from the command line
+const (
+	OUTPUT_KEYBOARD = "keyboard"
+	OUTPUT_GAMEPAD  = "gamepad"
+)
+
+// Names in the mapping that go to the mouse instead of the keyboard
+const (
+	MOUSE_X      = "mouse_x"
+	MOUSE_Y      = "mouse_y"
+	MOUSE_LEFT   = "mouse_left"
+	MOUSE_RIGHT  = "mouse_right"
+	MOUSE_CENTER = "mouse_center"
+	SCROLL_UP    = "scroll_up"
+	SCROLL_DOWN  = "scroll_down"
+)
+
+// The robotgo name of each mouse button
+var mouseButtons = map[string]string{
+	MOUSE_LEFT:   "left",
+	MOUSE_RIGHT:  "right",
+	MOUSE_CENTER: "center",
+}
+
+// newOutput creates the output picked on the command line
+func newOutput(cli CommandLine, mapping Mapping) (Output, error) {
+	switch cli.Output {
+	case OUTPUT_KEYBOARD:
+		return newKeyboardOutput(mapping), nil
+	case OUTPUT_GAMEPAD:
+		return openUinputGamepad(cli.Uinput)
+	}
+
+	return nil, fmt.Errorf("unknown output %s", cli.Output)
+}
+
+// KeyTracker remembers which keys are down so only presses and releases get
+// sent to the OS. Every input holding a key adds a reference to it and the
+// key is only released once no input holds it anymore
+type KeyTracker struct {
+	refs map[string]int
+	down map[string]bool
+
+	press   func(key string)
+	release func(key string)
+}
+
+func newKeyTracker(press, release func(key string)) *KeyTracker {
+	return &KeyTracker{
+		refs:    make(map[string]int),
+		down:    make(map[string]bool),
+		press:   press,
+		release: release,
+	}
+}
+
+// Hold adds a reference to a key until the next Flush
+func (t *KeyTracker) Hold(key string) {
+	t.refs[key]++
+}
+
+// Flush sends the keys that changed since the last Flush and starts over
+func (t *KeyTracker) Flush() {
+	// Release keys nobody holds anymore
+	for key := range t.down {
+		if t.refs[key] == 0 {
+			t.release(key)
+			delete(t.down, key)
+		}
+	}
+
+	// Press keys that just started being held
+	for key := range t.refs {
+		if !t.down[key] {
+			t.press(key)
+			t.down[key] = true
+		}
+	}
+
+	t.refs = make(map[string]int)
+}
+
+// ReleaseAll lets go of every key that is down
+func (t *KeyTracker) ReleaseAll() {
+	t.refs = make(map[string]int)
+	t.Flush()
+}
+
+// KeyboardOutput presses keys and moves the mouse following the mapping
+// section of the config
+type KeyboardOutput struct {
+	Mapping Mapping
+
+	keys *KeyTracker
+
+	// Mouse movement too small to move a whole pixel is saved for later
+	remainderX float32
+	remainderY float32
+	// Mouse speeds are per Interval, but the gamepad can be emitted more often
+	lastEmit time.Time
+}
+
+func newKeyboardOutput(mapping Mapping) *KeyboardOutput {
+	return &KeyboardOutput{
+		Mapping: mapping,
+		keys:    newKeyTracker(press, release),
+	}
+}
+
+// press holds down a key or mouse button, scrolling moves once per press
+func press(key string) {
+	if button, exists := mouseButtons[key]; exists {
+		robotgo.MouseToggle("down", button)
+	} else if key == SCROLL_UP {
+		robotgo.ScrollMouse(1, "up")
+	} else if key == SCROLL_DOWN {
+		robotgo.ScrollMouse(1, "down")
+	} else {
+		robotgo.KeyDown(key)
+	}
+}
+
+// release lets go of a key or mouse button
+func release(key string) {
+	if button, exists := mouseButtons[key]; exists {
+		robotgo.MouseToggle("up", button)
+	} else if key == SCROLL_UP || key == SCROLL_DOWN {
+		// Scrolling stops on its own
+	} else {
+		robotgo.KeyUp(key)
+	}
+}
+
+// mouseSpeed turns how far a stick is pushed into how many pixels to move
+func (m MouseConfig) mouseSpeed(value float32) float32 {
+	if abs32(value) <= m.Deadzone {
+		return 0
+	}
+
+	// Rescale what's left past the deadzone to 0 through 1 and run it through the curve
+	tilt := (abs32(value) - m.Deadzone) / (1 - m.Deadzone)
+	speed := m.Sensitivity * float32(math.Pow(float64(clamp32(tilt, 0, 1)), float64(m.Acceleration)))
+	if value < 0 {
+		return -speed
+	}
+	return speed
+}
+
+func (o *KeyboardOutput) Emit(state *glfw.GamepadState) error {
+	// Button events
+	for i := 0; i < len(state.Buttons); i++ {
+		button := glfw.GamepadButton(i)
+		if rule, exists := o.Mapping.Buttons[button]; exists {
+			if state.Buttons[button] == glfw.Press {
+				o.keys.Hold(rule.Key0)
+			}
+		}
+	}
+
+	// Only move the mouse as far as it should have since the last emit
+	now := time.Now()
+	scale := float32(1)
+	if !o.lastEmit.IsZero() {
+		scale = clamp32(float32(now.Sub(o.lastEmit))/float32(Interval), 0, 1)
+	}
+	o.lastEmit = now
+
+	// Joystick events
+	for _, axis := range JOYSTICK_AXES {
+		if rule, exists := o.Mapping.Axes[axis]; exists {
+			if rule.Key0 == MOUSE_X {
+				o.remainderX += o.Mapping.Mouse.mouseSpeed(state.Axes[axis]) * scale
+			} else if rule.Key0 == MOUSE_Y {
+				o.remainderY += o.Mapping.Mouse.mouseSpeed(state.Axes[axis]) * scale
+			} else if state.Axes[axis] > 0 {
+				// positives "right or down"
+				o.keys.Hold(rule.Key1)
+			} else if state.Axes[axis] < 0 {
+				// negatives "left or up"
+				o.keys.Hold(rule.Key0)
+			}
+		}
+	}
+
+	// Trigger events
+	for _, axis := range TRIGGER_AXES {
+		if rule, exists := o.Mapping.Axes[axis]; exists {
+			if state.Axes[axis] != -1 {
+				o.keys.Hold(rule.Key0)
+			}
+		}
+	}
+
+	// Only send the keys that changed
+	o.keys.Flush()
+
+	// Mouse movement, keeping the fractions of a pixel for next time
+	dx, dy := int(o.remainderX), int(o.remainderY)
+	o.remainderX -= float32(dx)
+	o.remainderY -= float32(dy)
+	if dx != 0 || dy != 0 {
+		robotgo.MoveRelative(dx, dy)
+	}
+
+	return nil
+}
+
+// SetMapping switches to another mapping. Keys the new mapping no longer
+// holds are let go of on the next Emit
+func (o *KeyboardOutput) SetMapping(mapping Mapping) {
+	o.Mapping = mapping
+}
+
+// Close lets go of every key the output is holding
+func (o *KeyboardOutput) Close() error {
+	o.keys.ReleaseAll()
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+
+	"github.com/go-gl/glfw/v3.3/glfw"
+)
+
+// Name of the profile made from the sections of the config outside of profiles
+const DEFAULT_PROFILE = "default"
+
+// Profile is how the gamepad gets played in one game
+type Profile struct {
+	Name        string
+	Mapping     Mapping
+	Multiplexer MultiplexerConfig
+	// How each client's axes are shaped in this game
+	Responses ClientResponses
+}
+
+// SetProfile switches to another game's mapping and multiplexer
+func (c *Core) SetProfile(name string) error {
+	profile, exists := c.Profiles[name]
+	if !exists {
+		return fmt.Errorf("no profile named %s", name)
+	}
+	multiplexer, err := newMultiplexer(profile.Multiplexer)
+	if err != nil {
+		return err
+	}
+
+	if output, ok := c.Output.(MappingOutput); ok {
+		output.SetMapping(profile.Mapping)
+	}
+	c.SetMultiplexer(multiplexer)
+	c.setResponses(profile.Responses)
+	c.profile = name
+	log.Printf("Playing with the %s profile\n", name)
+	return nil
+}
+
+// Profile is the name of the profile being played
+func (c *Core) Profile() string {
+	return c.profile
+}
+
+// ProfileNames lists every profile in the order the chord goes through them
+func (c *Core) ProfileNames() []string {
+	names := make([]string, 0, len(c.Profiles))
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetProfiles swaps in the profiles of a reloaded config. The same profile
+// keeps being played if it's still there, and its multiplexer is only
+// replaced when its settings changed so the current turn carries on
+func (c *Core) SetProfiles(profiles map[string]Profile, fallback string, chord []glfw.GamepadButton) {
+	old := c.Profiles[c.profile]
+	c.Profiles = profiles
+	c.ProfileChord = chord
+
+	profile, exists := profiles[c.profile]
+	if !exists {
+		log.Printf("The %s profile is gone\n", c.profile)
+		c.SetProfile(fallback)
+		return
+	}
+
+	if output, ok := c.Output.(MappingOutput); ok {
+		output.SetMapping(profile.Mapping)
+	}
+	c.setResponses(profile.Responses)
+	if !reflect.DeepEqual(old.Multiplexer, profile.Multiplexer) {
+		multiplexer, err := newMultiplexer(profile.Multiplexer)
+		if err == nil {
+			c.SetMultiplexer(multiplexer)
+		}
+	}
+}
+
+// setResponses makes the sessions shape axes the way the profile says, starting
+// with the next packet
+func (c *Core) setResponses(responses ClientResponses) {
+	if c.Responses != nil {
+		replaceResponses(c.Responses, responses)
+	}
+}
+
+// nextProfile moves on to the profile after the current one
+func (c *Core) nextProfile() {
+	names := c.ProfileNames()
+	for i, name := range names {
+		if name == c.profile {
+			c.SetProfile(names[(i+1)%len(names)])
+			return
+		}
+	}
+}
+
+// profileChordPressed checks if any joystick just started holding every
+// button of the profile chord. Only joysticks with rules count, and they can
+// use buttons their rules don't give them like the turn chord
+func (c *Core) profileChordPressed(rules InputRules) bool {
+	if len(c.ProfileChord) == 0 {
+		return false
+	}
+
+	before := len(c.chording)
+	for id := range c.chording {
+		if _, exists := rules[id]; !exists || !anyPressed(c.unmasked[id], c.ProfileChord) {
+			delete(c.chording, id)
+		}
+	}
+	for id := range rules {
+		if allPressed(c.unmasked[id], c.ProfileChord) {
+			c.chording[id] = true
+		}
+	}
+
+	// Only switch once per press of the chord, however many hold it
+	return before == 0 && len(c.chording) > 0
+}
+
+// withoutProfileChord is the joysticks with the chord buttons let go of on
+// the ones using them to switch profiles, until every chord button is released
+func (c *Core) withoutProfileChord() StatesMap {
+	if len(c.chording) == 0 {
+		return c.states
+	}
+
+	states := make(StatesMap, len(c.states))
+	for id, state := range c.states {
+		if c.chording[id] {
+			for _, button := range c.ProfileChord {
+				state.Buttons[button] = glfw.Release
+			}
+		}
+		states[id] = state
+	}
+	return states
+}
+
+// allPressed checks if every one of the buttons is pressed
+func allPressed(state glfw.GamepadState, buttons []glfw.GamepadButton) bool {
+	for _, button := range buttons {
+		if state.Buttons[button] != glfw.Press {
+			return false
+		}
+	}
+	return true
+}
+
+// anyPressed checks if any one of the buttons is pressed
+func anyPressed(state glfw.GamepadState, buttons []glfw.GamepadButton) bool {
+	for _, button := range buttons {
+		if state.Buttons[button] == glfw.Press {
+			return true
+		}
+	}
+	return false
+}
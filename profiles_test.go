@@ -0,0 +1,172 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-gl/glfw/v3.3/glfw"
+)
+
+func TestProfileChord(t *testing.T) {
+	core := newCore(nil, nil, time.Second, time.Minute)
+	core.Profiles = map[string]Profile{
+		DEFAULT_PROFILE: {Name: DEFAULT_PROFILE},
+		"racing":        {Name: "racing"},
+	}
+	core.ProfileChord = []glfw.GamepadButton{glfw.ButtonGuide, glfw.ButtonStart}
+	if err := core.SetProfile(DEFAULT_PROFILE); err != nil {
+		t.Fatal(err)
+	}
+
+	alice := InputId{1, 0}
+	stranger := InputId{2, 0}
+	rules := InputRules{alice: {{Button, glfw.ButtonStart, 0}, {Button, glfw.ButtonA, 0}}}
+
+	press := func(id InputId, buttons ...glfw.GamepadButton) {
+		state := resting
+		for _, button := range buttons {
+			state.Buttons[button] = glfw.Press
+		}
+		core.unmasked[id] = state
+		core.states[id] = mask(state, rules[id])
+	}
+	step := func() StatesMap {
+		if core.profileChordPressed(rules) {
+			core.nextProfile()
+		}
+		return core.withoutProfileChord()
+	}
+
+	steps := []struct {
+		name    string
+		id      InputId
+		buttons []glfw.GamepadButton
+		profile string
+		// Whether the game sees alice's start button
+		start bool
+	}{
+		{"joystick without rules", stranger, []glfw.GamepadButton{glfw.ButtonGuide, glfw.ButtonStart}, DEFAULT_PROFILE, false},
+		{"part of the chord", alice, []glfw.GamepadButton{glfw.ButtonStart}, DEFAULT_PROFILE, true},
+		{"whole chord", alice, []glfw.GamepadButton{glfw.ButtonGuide, glfw.ButtonStart, glfw.ButtonA}, "racing", false},
+		{"still held", alice, []glfw.GamepadButton{glfw.ButtonGuide, glfw.ButtonStart}, "racing", false},
+		{"partly let go", alice, []glfw.GamepadButton{glfw.ButtonStart}, "racing", false},
+		{"pressed again before letting go", alice, []glfw.GamepadButton{glfw.ButtonGuide, glfw.ButtonStart}, "racing", false},
+		{"let go", alice, nil, "racing", false},
+		{"start on its own", alice, []glfw.GamepadButton{glfw.ButtonStart}, "racing", true},
+		{"whole chord again", alice, []glfw.GamepadButton{glfw.ButtonGuide, glfw.ButtonStart}, DEFAULT_PROFILE, false},
+	}
+	for _, s := range steps {
+		press(s.id, s.buttons...)
+		states := step()
+		if core.Profile() != s.profile {
+			t.Fatalf("%s: playing %s, want %s", s.name, core.Profile(), s.profile)
+		}
+		if start := states[alice].Buttons[glfw.ButtonStart] == glfw.Press; start != s.start {
+			t.Fatalf("%s: game sees start %v, want %v", s.name, start, s.start)
+		}
+	}
+
+	// Buttons outside of the chord still get through while it's held
+	press(alice, glfw.ButtonGuide, glfw.ButtonStart, glfw.ButtonA)
+	if states := step(); states[alice].Buttons[glfw.ButtonA] != glfw.Press {
+		t.Fatal("chord held back a button outside of it")
+	}
+	if core.states[alice].Buttons[glfw.ButtonStart] != glfw.Press {
+		t.Fatal("stripping the chord changed the joystick's own state")
+	}
+}
+
+func TestProfileMouse(t *testing.T) {
+	config, err := loadConfigString(t, `mouse:
+  sensitivity: 5
+  deadzone: 0
+profiles:
+  racing:
+    mouse:
+      acceleration: 2
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := MouseConfig{5, 2, 0}
+	if got := config.Profiles["racing"].Mapping.Mouse; got != want {
+		t.Errorf("racing's mouse is %+v, want %+v", got, want)
+	}
+	want = MouseConfig{5, DEFAULT_MOUSE_ACCELERATION, 0}
+	if got := config.Profiles[DEFAULT_PROFILE].Mapping.Mouse; got != want {
+		t.Errorf("the default mouse is %+v, want %+v", got, want)
+	}
+}
+
+func TestProfileAxes(t *testing.T) {
+	config, err := loadConfigString(t, `clients:
+  alice:
+    joystick0: [AXIS_LEFT_X]
+  bob:
+    joystick0: [AXIS_LEFT_X]
+axes:
+  alice:
+    AXIS_LEFT_X:
+      deadzone: 0.1
+      invert: true
+profiles:
+  racing:
+    axes:
+      alice:
+        AXIS_LEFT_X:
+          deadzone: 0
+        AXIS_RIGHT_TRIGGER:
+          curve: exponential
+      bob:
+        AXIS_LEFT_Y:
+          radial: true
+  celeste:
+    mapping:
+      BUTTON_A: c
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stick := defaultResponse(glfw.AxisLeftX)
+	stick.Deadzone = 0.1
+	stick.Invert = true
+	racingStick := stick
+	racingStick.Deadzone = 0
+	trigger := defaultResponse(glfw.AxisRightTrigger)
+	trigger.Curve = CURVE_EXPONENTIAL
+	radial := defaultResponse(glfw.AxisLeftY)
+	radial.Radial = true
+
+	want := map[string]ClientResponses{
+		DEFAULT_PROFILE: {"alice": {glfw.AxisLeftX: stick}},
+		"celeste":       {"alice": {glfw.AxisLeftX: stick}},
+		"racing": {
+			"alice": {glfw.AxisLeftX: racingStick, glfw.AxisRightTrigger: trigger},
+			"bob":   {glfw.AxisLeftY: radial},
+		},
+	}
+	for name, responses := range want {
+		if got := config.Profiles[name].Responses; !reflect.DeepEqual(got, responses) {
+			t.Errorf("%s shapes axes with %+v, want %+v", name, got, responses)
+		}
+	}
+
+	// Switching profiles changes how the sessions shape axes
+	core := newCore(nil, nil, time.Second, time.Minute)
+	core.Profiles = config.Profiles
+	core.Responses = make(ClientResponses)
+	for _, name := range []string{"racing", DEFAULT_PROFILE, "racing", "celeste"} {
+		if err := core.SetProfile(name); err != nil {
+			t.Fatal(err)
+		}
+		clientLock.Lock()
+		same := reflect.DeepEqual(core.Responses, want[name])
+		clientLock.Unlock()
+		if !same {
+			t.Errorf("playing %s shapes axes differently than it says", name)
+		}
+	}
+}
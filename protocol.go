@@ -1,8 +1,10 @@
 package main
 
 import (
+	"crypto/cipher"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"math"
 	"regexp"
 	"time"
@@ -21,42 +23,59 @@ const (
 	PERIPHERAL_CONNECT    = 4
 	PERIPHERAL_DISCONNECT = 5
 	DONE                  = 6
+	TURN_START            = 7
+	TURN_END              = 8
+	KEY_EXCHANGE          = 9
+	SEALED                = 10
+	RESUME                = 11
+	RESUME_TOKEN          = 12
+	PING                  = 13
+	PONG                  = 14
+	RUMBLE                = 15
 	ERROR                 = 255
 )
 
-var GamestatePacketLen = 31
+// Version of the protocol this build speaks, and the oldest one it still understands.
+// Builds from before versions existed send a bare name in REGISTER and count as version 1
+const (
+	PROTOCOL_VERSION     uint8 = 7
+	MIN_PROTOCOL_VERSION uint8 = 4
+)
 
-type ControlProtocol struct {
-	Type uint8
-	Len  uint32
-	Data []byte
-}
+// The first protocol version that can resume a session after the connection drops
+const RESUME_PROTOCOL_VERSION uint8 = 5
 
-// Parse the data from the packet and convert to valid struct
-func (p *ControlProtocol) Parse(data []byte) error {
-	if len(data) < 5 {
-		return errors.New("packet improperly formatted")
-	}
+// The first protocol version where both sides ping each other
+const HEARTBEAT_PROTOCOL_VERSION uint8 = 6
 
-	pos := 0
+// The first protocol version where clients say which controller is plugged in where
+const PERIPHERAL_PROTOCOL_VERSION uint8 = 7
 
-	// Get the type
-	p.Type = data[pos]
-	pos++
+// Capability flags exchanged in the handshake, a feature is only used when
+// both sides have its flag
+const (
+	CAP_ANALOG_AXES uint32 = 1 << iota
+	CAP_RUMBLE
+	CAP_ENCRYPTION
+	CAP_COMPRESSION
+)
 
-	// Get the length of the data
-	p.Len = binary.BigEndian.Uint32(data[pos : pos+4])
-	pos += 4
+// The features this build supports
+const CAPABILITIES = CAP_ANALOG_AXES | CAP_RUMBLE | CAP_ENCRYPTION | CAP_COMPRESSION
 
-	// Make sure the packet size is right
-	if len(data)-5 < 0 || uint32(len(data)-5) < p.Len {
-		return errors.New("packet improperly formatted")
-	}
+var GamestatePacketLen = 40
 
-	// Get the data
-	p.Data = data[pos:(pos + int(p.Len))]
+// Compressed keyframes are the header, token, changed mask, buttons and int16 axes.
+// Deltas swap the buttons and axes for the keyframe's id and only what changed
+const (
+	compressedKeyframeLen = 6 + 8 + 1 + 2 + 12
+	compressedDeltaMinLen = 6 + 8 + 1 + 4
+)
 
-	return nil
+type ControlProtocol struct {
+	Type uint8
+	Len  uint32
+	Data []byte
 }
 
 // Bytes turns the data from the packet into the byte slice it represents
@@ -83,23 +102,123 @@ func (p *ControlProtocol) Error(msg string) []byte {
 }
 
 // Register returns a REGISTER packet to send
-func (p *ControlProtocol) Register(name string) []byte {
+// 1 byte protocol version, 4 bytes capabilities then the name
+func (p *ControlProtocol) Register(version uint8, capabilities uint32, name string) []byte {
 	p.Type = REGISTER
-	p.Len = uint32(len(name))
-	p.Data = []byte(name)
+	p.Data = make([]byte, 5, 5+len(name))
+	p.Data[0] = version
+	binary.BigEndian.PutUint32(p.Data[1:], capabilities)
+	p.Data = append(p.Data, name...)
+	p.Len = uint32(len(p.Data))
+
+	return p.Bytes()
+}
+
+// ParseRegister gets the protocol version, capabilities and name out of a REGISTER packet
+func (p *ControlProtocol) ParseRegister() (version uint8, capabilities uint32, name string, err error) {
+	if p.Type != REGISTER {
+		return 0, 0, "", errors.New("expecting a REGISTER packet")
+	}
+
+	// Old clients only send their name, which always starts with a printable character
+	if len(p.Data) > 0 && p.Data[0] >= ' ' {
+		return 1, 0, string(p.Data), nil
+	}
+
+	if len(p.Data) < 5 {
+		return 0, 0, "", errors.New("REGISTER packet is too short")
+	}
+	return p.Data[0], binary.BigEndian.Uint32(p.Data[1:]), string(p.Data[5:]), nil
+}
+
+// Resume returns a RESUME packet to send in place of REGISTER to pick a dropped session back up
+// 1 byte protocol version, 4 bytes capabilities, 8 bytes resume token then the name
+func (p *ControlProtocol) Resume(version uint8, capabilities uint32, resume SessionToken, name string) []byte {
+	p.Type = RESUME
+	p.Data = make([]byte, 5, 13+len(name))
+	p.Data[0] = version
+	binary.BigEndian.PutUint32(p.Data[1:], capabilities)
+	p.Data = append(p.Data, resume[:]...)
+	p.Data = append(p.Data, name...)
+	p.Len = uint32(len(p.Data))
+
+	return p.Bytes()
+}
+
+// ParseResume gets the protocol version, capabilities, resume token and name out of a RESUME packet
+func (p *ControlProtocol) ParseResume() (
+	version uint8,
+	capabilities uint32,
+	resume SessionToken,
+	name string,
+	err error,
+) {
+	if p.Type != RESUME || len(p.Data) < 13 {
+		return 0, 0, resume, "", errors.New("expecting a RESUME packet")
+	}
+	copy(resume[:], p.Data[5:])
+	return p.Data[0], binary.BigEndian.Uint32(p.Data[1:]), resume, string(p.Data[13:]), nil
+}
+
+// ResumeToken returns a RESUME_TOKEN packet to send
+// 8 bytes token the client can resume the session with
+func (p *ControlProtocol) ResumeToken(resume SessionToken) []byte {
+	p.Type = RESUME_TOKEN
+	p.Len = uint32(len(resume))
+	p.Data = append([]byte{}, resume[:]...)
 
 	return p.Bytes()
 }
 
+// ParseResumeToken gets the resume token out of a RESUME_TOKEN packet
+func (p *ControlProtocol) ParseResumeToken() (resume SessionToken, err error) {
+	if p.Type != RESUME_TOKEN || len(p.Data) != len(resume) {
+		return resume, errors.New("expecting a RESUME_TOKEN packet")
+	}
+	copy(resume[:], p.Data)
+	return resume, nil
+}
+
 // SetId returns a SET_ID packet to send
-func (p *ControlProtocol) SetId(id uint8) []byte {
+// 1 byte id, 1 byte agreed protocol version, 4 bytes agreed capabilities
+// then 8 bytes session token
+func (p *ControlProtocol) SetId(id uint8, version uint8, capabilities uint32, token SessionToken) []byte {
 	p.Type = SET_ID
-	p.Len = 1
-	p.Data = []byte{id}
+	p.Len = 14
+	p.Data = make([]byte, 6, 14)
+	p.Data[0] = id
+	p.Data[1] = version
+	binary.BigEndian.PutUint32(p.Data[2:], capabilities)
+	p.Data = append(p.Data, token[:]...)
 
 	return p.Bytes()
 }
 
+// ParseSetId gets the id, protocol version, capabilities and session token out of a SET_ID packet
+func (p *ControlProtocol) ParseSetId() (id uint8, version uint8, capabilities uint32, token SessionToken, err error) {
+	if p.Type != SET_ID || len(p.Data) != 14 {
+		return 0, 0, 0, token, errors.New("expecting a SET_ID packet")
+	}
+	copy(token[:], p.Data[6:])
+	return p.Data[0], p.Data[1], binary.BigEndian.Uint32(p.Data[2:]), token, nil
+}
+
+// negotiate works out the protocol version and capabilities both sides can use
+func negotiate(version uint8, capabilities uint32) (uint8, uint32, error) {
+	if version < MIN_PROTOCOL_VERSION {
+		return 0, 0, fmt.Errorf(
+			"protocol version %d is too old, version %d or newer is needed, please update",
+			version, MIN_PROTOCOL_VERSION,
+		)
+	}
+
+	// Newer peers have to talk down to us
+	if version > PROTOCOL_VERSION {
+		version = PROTOCOL_VERSION
+	}
+	return version, capabilities & CAPABILITIES, nil
+}
+
 // Configure returns a CONFIGURATION packet to send
 func (p *ControlProtocol) Configure(data []byte) []byte {
 	p.Type = CONFIGURATION
@@ -109,16 +228,176 @@ func (p *ControlProtocol) Configure(data []byte) []byte {
 	return p.Bytes()
 }
 
+// Done returns a DONE packet to send
+// The server sends the reason it ended the session, clients send nothing
+func (p *ControlProtocol) Done(reason string) []byte {
+	p.Type = DONE
+	p.Len = uint32(len(reason))
+	p.Data = []byte(reason)
+
+	return p.Bytes()
+}
+
+// TurnStart returns a TURN_START packet to send
+func (p *ControlProtocol) TurnStart() []byte {
+	p.Type = TURN_START
+	p.Len = 0
+	p.Data = []byte{}
+
+	return p.Bytes()
+}
+
+// TurnEnd returns a TURN_END packet to send
+func (p *ControlProtocol) TurnEnd() []byte {
+	p.Type = TURN_END
+	p.Len = 0
+	p.Data = []byte{}
+
+	return p.Bytes()
+}
+
+// Ping returns a PING packet to send
+// 8 bytes the peer echoes back in its PONG
+func (p *ControlProtocol) Ping(sent uint64) []byte {
+	p.Type = PING
+	p.Len = 8
+	p.Data = make([]byte, 8)
+	binary.BigEndian.PutUint64(p.Data, sent)
+
+	return p.Bytes()
+}
+
+// Pong returns a PONG packet answering a PING
+func (p *ControlProtocol) Pong(ping *ControlProtocol) []byte {
+	p.Type = PONG
+	p.Len = uint32(len(ping.Data))
+	p.Data = ping.Data
+
+	return p.Bytes()
+}
+
+// Rumble returns a RUMBLE packet to send
+// 1 byte joystick or ALL_JOYSTICKS, 2 bytes strong motor, 2 bytes weak motor
+// then 2 bytes duration in milliseconds
+func (p *ControlProtocol) Rumble(joystick uint8, effect Rumble) []byte {
+	if effect.Duration > MAX_RUMBLE_DURATION {
+		effect.Duration = MAX_RUMBLE_DURATION
+	}
+
+	p.Type = RUMBLE
+	p.Len = 7
+	p.Data = make([]byte, 7)
+	p.Data[0] = joystick
+	binary.BigEndian.PutUint16(p.Data[1:], effect.Strong)
+	binary.BigEndian.PutUint16(p.Data[3:], effect.Weak)
+	binary.BigEndian.PutUint16(p.Data[5:], uint16(effect.Duration.Milliseconds()))
+
+	return p.Bytes()
+}
+
+// ParseRumble gets the joystick and effect out of a RUMBLE packet
+func (p *ControlProtocol) ParseRumble() (joystick uint8, effect Rumble, err error) {
+	if p.Type != RUMBLE || len(p.Data) != 7 {
+		return 0, effect, errors.New("expecting a RUMBLE packet")
+	}
+	effect.Strong = binary.BigEndian.Uint16(p.Data[1:])
+	effect.Weak = binary.BigEndian.Uint16(p.Data[3:])
+	effect.Duration = time.Duration(binary.BigEndian.Uint16(p.Data[5:])) * time.Millisecond
+	return p.Data[0], effect, nil
+}
+
+// PeripheralConnect returns a PERIPHERAL_CONNECT packet to send
+// 1 byte joystick, 1 byte GUID length, the GUID then the gamepad name
+func (p *ControlProtocol) PeripheralConnect(peripheral Peripheral) []byte {
+	guid := []byte(peripheral.GUID)
+	if len(guid) > 0xFF {
+		guid = guid[:0xFF]
+	}
+
+	p.Type = PERIPHERAL_CONNECT
+	p.Data = append([]byte{peripheral.Joystick, uint8(len(guid))}, guid...)
+	p.Data = append(p.Data, peripheral.Name...)
+	p.Len = uint32(len(p.Data))
+
+	return p.Bytes()
+}
+
+// ParsePeripheralConnect gets the controller out of a PERIPHERAL_CONNECT packet
+func (p *ControlProtocol) ParsePeripheralConnect() (peripheral Peripheral, err error) {
+	if p.Type != PERIPHERAL_CONNECT || len(p.Data) < 2 || len(p.Data) < 2+int(p.Data[1]) {
+		return peripheral, errors.New("expecting a PERIPHERAL_CONNECT packet")
+	}
+	peripheral.Joystick = p.Data[0]
+	peripheral.GUID = string(p.Data[2 : 2+p.Data[1]])
+	peripheral.Name = string(p.Data[2+p.Data[1]:])
+	return peripheral, nil
+}
+
+// PeripheralDisconnect returns a PERIPHERAL_DISCONNECT packet to send
+// 1 byte joystick
+func (p *ControlProtocol) PeripheralDisconnect(joystick uint8) []byte {
+	p.Type = PERIPHERAL_DISCONNECT
+	p.Len = 1
+	p.Data = []byte{joystick}
+
+	return p.Bytes()
+}
+
+// ParsePeripheralDisconnect gets the joystick out of a PERIPHERAL_DISCONNECT packet
+func (p *ControlProtocol) ParsePeripheralDisconnect() (joystick uint8, err error) {
+	if p.Type != PERIPHERAL_DISCONNECT || len(p.Data) != 1 {
+		return 0, errors.New("expecting a PERIPHERAL_DISCONNECT packet")
+	}
+	return p.Data[0], nil
+}
+
+// KeyExchange returns a KEY_EXCHANGE packet to send with an X25519 public key
+func (p *ControlProtocol) KeyExchange(public []byte) []byte {
+	p.Type = KEY_EXCHANGE
+	p.Len = uint32(len(public))
+	p.Data = public
+
+	return p.Bytes()
+}
+
+// Sealed returns a SEALED packet to send
+// 8 bytes counter then an encrypted packet
+func (p *ControlProtocol) Sealed(data []byte) []byte {
+	p.Type = SEALED
+	p.Len = uint32(len(data))
+	p.Data = data
+
+	return p.Bytes()
+}
+
+// The packet id, client id and device id are left in the clear so the server
+// knows which session's key opens the rest
+const gamestateHeaderLen = 6
+
+// GamestateProtocol carries the state of one joystick plugged into a client.
+// Clients with several joysticks send a packet for each of them
 type GamestateProtocol struct {
 	PacketId     uint32
-	JoystickId   uint8
+	ClientId     uint8
+	DeviceId     uint8
+	Token        SessionToken
 	GamepadState glfw.GamepadState
+
+	// Compressed packets are used when both sides have CAP_COMPRESSION. They're
+	// either a keyframe or the fields that changed since the keyframe with id Base
+	Compressed bool
+	Changed    uint8
+	Base       uint32
 }
 
 // Parse the data from the packet and convert to valid struct
 func (p *GamestateProtocol) Parse(data []byte) error {
+	if p.Compressed {
+		return p.parseCompressed(data)
+	}
+
 	// Bad packet length
-	if len(data) != 31 {
+	if len(data) != GamestatePacketLen {
 		return errors.New("invalid packet length")
 	}
 
@@ -127,10 +406,18 @@ func (p *GamestateProtocol) Parse(data []byte) error {
 	p.PacketId = binary.BigEndian.Uint32(data)
 	pos += 4
 
-	// Get the joystick id
-	p.JoystickId = data[pos]
+	// Get the client id
+	p.ClientId = data[pos]
+	pos++
+
+	// Get the joystick's index on the client
+	p.DeviceId = data[pos]
 	pos++
 
+	// Get the session token
+	copy(p.Token[:], data[pos:])
+	pos += len(p.Token)
+
 	// Get the buttons by turning each bit into the correct position in the array
 	for i := 0; i < 15; i++ {
 		p.GamepadState.Buttons[i] = glfw.Action((data[pos+int(i/8)] >> (7 - (i % 8))) & 1)
@@ -151,18 +438,30 @@ func (p *GamestateProtocol) Parse(data []byte) error {
 
 // Bytes turns the data from the packet into the byte slice it represents
 func (p GamestateProtocol) Bytes() []byte {
+	if p.Compressed {
+		return p.compressedBytes()
+	}
+
 	// Create our byte slice
-	b := make([]byte, 31, 31)
+	b := make([]byte, GamestatePacketLen)
 	pos := 0
 
 	// Get our packet id
 	binary.BigEndian.PutUint32(b, p.PacketId)
 	pos += 4
 
-	// Get the joystick id
-	b[pos] = p.JoystickId
+	// Get the client id
+	b[pos] = p.ClientId
+	pos++
+
+	// Get the joystick's index on the client
+	b[pos] = p.DeviceId
 	pos++
 
+	// Get the session token
+	copy(b[pos:], p.Token[:])
+	pos += len(p.Token)
+
 	// Get the buttons by turning each bit into the correct position in the array
 	for i := 0; i < 15; i++ {
 		b[pos+int(i/8)] |= byte(p.GamepadState.Buttons[i] << (7 - (i % 8)))
@@ -178,6 +477,115 @@ func (p GamestateProtocol) Bytes() []byte {
 	return b
 }
 
+// parseCompressed parses a keyframe or a delta. Fields a delta leaves out
+// are filled in by a DeltaDecoder
+func (p *GamestateProtocol) parseCompressed(data []byte) error {
+	if len(data) < compressedDeltaMinLen {
+		return errors.New("invalid packet length")
+	}
+
+	p.PacketId = binary.BigEndian.Uint32(data)
+	p.ClientId = data[4]
+	p.DeviceId = data[5]
+	copy(p.Token[:], data[6:])
+	p.Changed = data[14]
+	pos := 15
+
+	// The length has to match what the mask says is in the packet
+	want := compressedKeyframeLen
+	if p.Changed&DELTA_KEYFRAME == 0 {
+		want = compressedDeltaMinLen
+		if p.Changed&DELTA_BUTTONS != 0 {
+			want += 2
+		}
+		for axis := range p.GamepadState.Axes {
+			if p.Changed&(DELTA_AXES<<axis) != 0 {
+				want += 2
+			}
+		}
+
+		p.Base = binary.BigEndian.Uint32(data[pos:])
+		pos += 4
+	} else if p.Changed != DELTA_KEYFRAME {
+		return errors.New("keyframe has changed fields")
+	}
+	if len(data) != want {
+		return errors.New("invalid packet length")
+	}
+
+	full := p.Changed&DELTA_KEYFRAME != 0
+	if full || p.Changed&DELTA_BUTTONS != 0 {
+		for i := 0; i < 15; i++ {
+			p.GamepadState.Buttons[i] = glfw.Action((data[pos+int(i/8)] >> (7 - (i % 8))) & 1)
+		}
+		pos += 2
+	}
+	for axis := range p.GamepadState.Axes {
+		if full || p.Changed&(DELTA_AXES<<axis) != 0 {
+			p.GamepadState.Axes[axis] = dequantize(int16(binary.BigEndian.Uint16(data[pos:])))
+			pos += 2
+		}
+	}
+
+	return nil
+}
+
+// compressedBytes turns a keyframe or a delta into the byte slice it represents
+func (p GamestateProtocol) compressedBytes() []byte {
+	b := make([]byte, 15, compressedKeyframeLen)
+	binary.BigEndian.PutUint32(b, p.PacketId)
+	b[4] = p.ClientId
+	b[5] = p.DeviceId
+	copy(b[6:], p.Token[:])
+	b[14] = p.Changed
+
+	full := p.Changed&DELTA_KEYFRAME != 0
+	if !full {
+		b = append(b, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(b[15:], p.Base)
+	}
+
+	if full || p.Changed&DELTA_BUTTONS != 0 {
+		var buttons [2]byte
+		for i := 0; i < 15; i++ {
+			buttons[i/8] |= byte(p.GamepadState.Buttons[i] << (7 - (i % 8)))
+		}
+		b = append(b, buttons[:]...)
+	}
+	for axis := range p.GamepadState.Axes {
+		if full || p.Changed&(DELTA_AXES<<axis) != 0 {
+			b = append(b, 0, 0)
+			binary.BigEndian.PutUint16(b[len(b)-2:], uint16(quantize(p.GamepadState.Axes[axis])))
+		}
+	}
+
+	return b
+}
+
+// Seal returns the packet with everything after the header encrypted
+func (p GamestateProtocol) Seal(aead cipher.AEAD) []byte {
+	b := p.Bytes()
+	header := append([]byte{}, b[:gamestateHeaderLen]...)
+	return aead.Seal(header, datagramNonce(p.PacketId), b[gamestateHeaderLen:], header)
+}
+
+// Open decrypts a sealed packet and parses it
+func (p *GamestateProtocol) Open(aead cipher.AEAD, data []byte) error {
+	// Parse checks the exact length once the packet is open
+	if len(data) < gamestateHeaderLen+aead.Overhead() {
+		return errors.New("invalid packet length")
+	}
+
+	header := data[:gamestateHeaderLen]
+	packetId := binary.BigEndian.Uint32(header)
+	plain, err := aead.Open(nil, datagramNonce(packetId), data[gamestateHeaderLen:], header)
+	if err != nil {
+		return err
+	}
+
+	return p.Parse(append(append([]byte{}, header...), plain...))
+}
+
 func (rules RulesMap) Bytes() []byte {
 	length := 0
 	for _, array := range rules {
@@ -211,15 +619,22 @@ func ParseRulesMap(bytes []byte) (RulesMap, error) {
 		rules[joystick] = make([]MultiplexRule, 0)
 
 		i++
-		for bytes[i] != 255 {
+		for ; i < len(bytes) && bytes[i] != 255; i++ {
 			var rule MultiplexRule
 			if bytes[i]&128 == 0 {
 				rule = MultiplexRule{Button, glfw.GamepadButton(bytes[i] & 127), 0}
 			} else {
 				rule = MultiplexRule{Axis, 0, glfw.GamepadAxis(bytes[i] & 127)}
 			}
+			if rule.Button > glfw.ButtonLast || rule.Axis > glfw.AxisLast {
+				return nil, errors.New("configuration has an unknown button or axis")
+			}
 			rules[joystick] = append(rules[joystick], rule)
-			i++
+		}
+
+		// Every joystick's rules end with 0xFF
+		if i == len(bytes) {
+			return nil, errors.New("configuration ended in the middle of a joystick")
 		}
 	}
 
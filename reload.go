@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// How often the server checks whether the config file changed
+const CONFIG_POLL_INTERVAL time.Duration = time.Second
+
+// watchConfig reloads the config whenever the file changes or the server gets a SIGHUP
+func watchConfig(filename string, rules ClientsMap) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	ticker := time.NewTicker(CONFIG_POLL_INTERVAL)
+	defer ticker.Stop()
+
+	modified := modTime(filename)
+	for {
+		select {
+		case <-hangups:
+			log.Println("Got SIGHUP, reloading the config")
+		case <-ticker.C:
+			latest := modTime(filename)
+			if latest.Equal(modified) {
+				continue
+			}
+			log.Println("The config changed, reloading it")
+		}
+
+		// Keep the modification time of whatever was read last, so a config that
+		// changes again while reloading gets reloaded again
+		modified = modTime(filename)
+		reloadConfig(filename, rules)
+	}
+}
+
+// modTime is when a file was last changed, or zero if it can't be read
+func modTime(filename string) time.Time {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// reloadConfig applies a new config, or keeps the old one when it has errors.
+// The profile being played stays the same so reloading for a new key binding
+// doesn't end the current turn. The rules, axes and profiles are swapped in
+// together between two updates, so nothing is multiplexed with half of each
+func reloadConfig(filename string, rules ClientsMap) {
+	config, err := loadConfig(filename)
+	if err != nil {
+		logConfigError(err)
+		log.Println("Keeping the old config")
+		return
+	}
+
+	var changed, removed []*ServerConn
+	runOnCore(func(core *Core) {
+		changed, removed = swapRules(rules, config.Rules)
+		core.SetProfiles(config.Profiles, config.Profile, config.ProfileChord)
+	})
+
+	// Clients only hear about it once it's all in place
+	for _, client := range changed {
+		client.sendRules()
+	}
+	for _, client := range removed {
+		client.Kick("removed from the config")
+	}
+
+	log.Println("Reloaded the config")
+}
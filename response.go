@@ -0,0 +1,173 @@
+package main
+
+import (
+	"math"
+
+	"github.com/go-gl/glfw/v3.3/glfw"
+)
+
+// Response curves an axis can go through after its deadzone
+const (
+	CURVE_LINEAR      = "linear"
+	CURVE_EXPONENTIAL = "exponential"
+	CURVE_CUSTOM      = "custom"
+)
+
+// How far an axis has to move to count as pushed, for axes that aren't
+// shaped and as the deadzone of shaped axes that don't set one
+const STICK_DEADZONE float32 = 0.20
+const TRIGGER_DEADZONE float32 = 0.40
+
+// Exponent of the exponential curve when the config leaves it out
+const DEFAULT_CURVE_EXPONENT float32 = 2
+
+// AxisResponse is how one axis of a client's joysticks gets shaped before
+// it's multiplexed, to make up for drift and for how different controllers feel.
+// Sticks are worked on by how far they're pushed from the center and
+// triggers by how far they're pulled, both from 0 to 1
+type AxisResponse struct {
+	// Anything pushed less than Deadzone counts as nothing, and anything
+	// within OuterDeadzone of the edge counts as all the way
+	Deadzone      float32
+	OuterDeadzone float32
+	// Radial deadzones go by how far the whole stick is pushed instead of
+	// just this axis, so the stick doesn't snap to straight lines
+	Radial bool
+	Invert bool
+	// Multiplies the axis after the curve
+	Sensitivity float32
+	Curve       string
+	Exponent    float32
+	// Points the custom curve goes through, from x 0 to 1
+	Points [][2]float32
+}
+
+// AxisOptions is an axis of the axes section as it's written in the config.
+// Settings that are left out are nil so they can be told apart from ones set to 0
+type AxisOptions struct {
+	Deadzone      *float32     `yaml:"deadzone"`
+	OuterDeadzone *float32     `yaml:"outer_deadzone"`
+	Radial        *bool        `yaml:"radial"`
+	Invert        *bool        `yaml:"invert"`
+	Sensitivity   *float32     `yaml:"sensitivity"`
+	Curve         *string      `yaml:"curve"`
+	Exponent      *float32     `yaml:"exponent"`
+	Points        [][2]float32 `yaml:"points"`
+}
+
+// defaultResponse is how an axis is shaped when the config gives it a
+// response but leaves everything in it out
+func defaultResponse(axis glfw.GamepadAxis) AxisResponse {
+	deadzone := STICK_DEADZONE
+	if isTrigger(axis) {
+		deadzone = TRIGGER_DEADZONE
+	}
+	return AxisResponse{
+		Deadzone:    deadzone,
+		Sensitivity: 1,
+		Curve:       CURVE_LINEAR,
+		Exponent:    DEFAULT_CURVE_EXPONENT,
+	}
+}
+
+// ResponseMap is how each axis of a client's joysticks is shaped
+type ResponseMap map[glfw.GamepadAxis]AxisResponse
+
+// ClientResponses holds how every client shapes their axes, by name
+type ClientResponses map[string]ResponseMap
+
+// Apply shapes every axis of a state. Axes without a response get the default
+// deadzone, and anything inside a deadzone is put back at rest so
+// multiplexers only have to tell if an axis left rest
+func (r ResponseMap) Apply(state glfw.GamepadState) glfw.GamepadState {
+	raw := state.Axes
+	for i := range state.Axes {
+		axis := glfw.GamepadAxis(i)
+		if response, exists := r[axis]; exists {
+			state.Axes[axis] = response.apply(axis, raw)
+		} else {
+			state.Axes[axis] = settle(axis, state.Axes[axis])
+		}
+	}
+	return state
+}
+
+// apply shapes one axis of the raw axes of a joystick
+func (r AxisResponse) apply(axis glfw.GamepadAxis, raw [6]float32) float32 {
+	value := raw[axis]
+	if isTrigger(axis) {
+		// Triggers go from -1 to 1, work on them from 0 to 1
+		return r.shape((value+1)/2)*2 - 1
+	}
+
+	if r.Invert {
+		value = -value
+	}
+	distance := abs32(value)
+	if r.Radial {
+		other := raw[stickPartner(axis)]
+		distance = float32(math.Hypot(float64(value), float64(other)))
+	}
+	if distance == 0 {
+		return 0
+	}
+
+	// Keep the direction and shape how far it's pushed
+	return clamp32(value/distance*r.shape(clamp32(distance, 0, 1)), -1, 1)
+}
+
+// settle puts an axis back at rest when it's inside the default deadzone
+func settle(axis glfw.GamepadAxis, value float32) float32 {
+	if isTrigger(axis) {
+		if value <= -1+TRIGGER_DEADZONE {
+			return -1
+		}
+		return value
+	}
+	if abs32(value) <= STICK_DEADZONE {
+		return 0
+	}
+	return value
+}
+
+// shape runs how far an axis is pushed through the deadzones, curve and sensitivity
+func (r AxisResponse) shape(pushed float32) float32 {
+	if pushed <= r.Deadzone {
+		return 0
+	}
+	pushed = clamp32((pushed-r.Deadzone)/(1-r.Deadzone-r.OuterDeadzone), 0, 1)
+
+	switch r.Curve {
+	case CURVE_EXPONENTIAL:
+		pushed = float32(math.Pow(float64(pushed), float64(r.Exponent)))
+	case CURVE_CUSTOM:
+		pushed = interpolate(r.Points, pushed)
+	}
+
+	return clamp32(pushed*r.Sensitivity, 0, 1)
+}
+
+// interpolate finds y at x on the lines between the points
+func interpolate(points [][2]float32, x float32) float32 {
+	for i := 1; i < len(points); i++ {
+		if x <= points[i][0] {
+			x0, y0 := points[i-1][0], points[i-1][1]
+			x1, y1 := points[i][0], points[i][1]
+			return y0 + (x-x0)/(x1-x0)*(y1-y0)
+		}
+	}
+	return points[len(points)-1][1]
+}
+
+// stickPartner is the other axis of the same stick
+func stickPartner(axis glfw.GamepadAxis) glfw.GamepadAxis {
+	switch axis {
+	case glfw.AxisLeftX:
+		return glfw.AxisLeftY
+	case glfw.AxisLeftY:
+		return glfw.AxisLeftX
+	case glfw.AxisRightX:
+		return glfw.AxisRightY
+	}
+	return glfw.AxisRightX
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/go-gl/glfw/v3.3/glfw"
+)
+
+// near checks if two axis values are the same give or take rounding
+func near(a, b float32) bool {
+	return math.Abs(float64(a-b)) < 1e-4
+}
+
+// linear is a response the way the config fills one in when only the
+// deadzone is given
+func linear(deadzone float32) AxisResponse {
+	return AxisResponse{Deadzone: deadzone, Sensitivity: 1, Curve: CURVE_LINEAR}
+}
+
+func TestShape(t *testing.T) {
+	custom := [][2]float32{{0, 0}, {0.5, 0.2}, {1, 1}}
+	tests := []struct {
+		name     string
+		response AxisResponse
+		pushed   float32
+		want     float32
+	}{
+		{"linear", linear(0), 0.5, 0.5},
+		{"at rest", linear(0), 0, 0},
+		{"all the way", linear(0), 1, 1},
+		{"inside the deadzone", linear(0.2), 0.1, 0},
+		{"on the deadzone", linear(0.2), 0.2, 0},
+		{"just past the deadzone", linear(0.2), 0.21, 0.0125},
+		{"past the deadzone", linear(0.2), 0.6, 0.5},
+		{"deadzone all the way", linear(0.2), 1, 1},
+		{"before the outer deadzone", AxisResponse{OuterDeadzone: 0.2, Sensitivity: 1}, 0.4, 0.5},
+		{"on the outer deadzone", AxisResponse{OuterDeadzone: 0.2, Sensitivity: 1}, 0.8, 1},
+		{"inside the outer deadzone", AxisResponse{OuterDeadzone: 0.2, Sensitivity: 1}, 0.9, 1},
+		{"both deadzones", AxisResponse{Deadzone: 0.2, OuterDeadzone: 0.2, Sensitivity: 1}, 0.5, 0.5},
+		{"exponential", AxisResponse{Sensitivity: 1, Curve: CURVE_EXPONENTIAL, Exponent: 2}, 0.5, 0.25},
+		{"exponential past the deadzone", AxisResponse{Deadzone: 0.5, Sensitivity: 1, Curve: CURVE_EXPONENTIAL, Exponent: 3}, 0.75, 0.125},
+		{"custom on a point", AxisResponse{Sensitivity: 1, Curve: CURVE_CUSTOM, Points: custom}, 0.5, 0.2},
+		{"custom between points", AxisResponse{Sensitivity: 1, Curve: CURVE_CUSTOM, Points: custom}, 0.75, 0.6},
+		{"custom past the deadzone", AxisResponse{Deadzone: 0.5, Sensitivity: 1, Curve: CURVE_CUSTOM, Points: custom}, 0.625, 0.1},
+		{"sensitivity", AxisResponse{Sensitivity: 2}, 0.3, 0.6},
+		{"sensitivity stops at 1", AxisResponse{Sensitivity: 2}, 0.8, 1},
+		{"low sensitivity", AxisResponse{Sensitivity: 0.5}, 1, 0.5},
+		{"no sensitivity", AxisResponse{Sensitivity: 0}, 1, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.response.shape(test.pushed); !near(got, test.want) {
+				t.Fatalf("shaped %g into %g, want %g", test.pushed, got, test.want)
+			}
+		})
+	}
+}
+
+func TestInterpolate(t *testing.T) {
+	points := [][2]float32{{0, 0}, {0.25, 0.5}, {1, 1}}
+	tests := []struct {
+		x, want float32
+	}{
+		{0, 0},
+		{0.125, 0.25},
+		{0.25, 0.5},
+		{0.625, 0.75},
+		{1, 1},
+	}
+
+	for _, test := range tests {
+		if got := interpolate(points, test.x); !near(got, test.want) {
+			t.Errorf("at %g got %g, want %g", test.x, got, test.want)
+		}
+	}
+}
+
+func TestResponseApply(t *testing.T) {
+	const lx, ly, rx, ry = glfw.AxisLeftX, glfw.AxisLeftY, glfw.AxisRightX, glfw.AxisRightY
+	const lt, rt = glfw.AxisLeftTrigger, glfw.AxisRightTrigger
+	radial := linear(0.2)
+	radial.Radial = true
+	inverted := radial
+	inverted.Invert = true
+
+	tests := []struct {
+		name      string
+		responses ResponseMap
+		axes      map[glfw.GamepadAxis]float32
+		want      map[glfw.GamepadAxis]float32
+	}{
+		{
+			"default deadzones",
+			nil,
+			map[glfw.GamepadAxis]float32{lx: 0.15, ly: -0.2, rx: 0.25, lt: -0.7, rt: -0.5},
+			map[glfw.GamepadAxis]float32{lx: 0, ly: 0, rx: 0.25, lt: -1, rt: -0.5},
+		},
+		{
+			"deadzone under the default",
+			ResponseMap{lx: linear(0.05), lt: linear(0.1)},
+			map[glfw.GamepadAxis]float32{lx: 0.15, ly: 0.15, lt: -0.7},
+			map[glfw.GamepadAxis]float32{lx: 0.1053, ly: 0, lt: -0.8889},
+		},
+		{
+			"deadzone over the default",
+			ResponseMap{lx: linear(0.5), rt: linear(0.6)},
+			map[glfw.GamepadAxis]float32{lx: -0.4, rt: 0},
+			map[glfw.GamepadAxis]float32{lx: 0, rt: -1},
+		},
+		{
+			"trigger at rest",
+			ResponseMap{lt: linear(0.1)},
+			map[glfw.GamepadAxis]float32{lt: -1},
+			map[glfw.GamepadAxis]float32{lt: -1},
+		},
+		{
+			"deadzone 0",
+			ResponseMap{lx: linear(0), lt: linear(0)},
+			map[glfw.GamepadAxis]float32{lx: 0.01, ly: 0.15, lt: -0.98},
+			map[glfw.GamepadAxis]float32{lx: 0.01, ly: 0, lt: -0.98},
+		},
+		{
+			"exponential with deadzone 0",
+			ResponseMap{lx: AxisResponse{Sensitivity: 1, Curve: CURVE_EXPONENTIAL, Exponent: 2}},
+			map[glfw.GamepadAxis]float32{lx: -0.4},
+			map[glfw.GamepadAxis]float32{lx: -0.16},
+		},
+		{
+			"default response",
+			ResponseMap{lx: defaultResponse(lx), rt: defaultResponse(rt)},
+			map[glfw.GamepadAxis]float32{lx: 0.6, rt: 0.6},
+			map[glfw.GamepadAxis]float32{lx: 0.5, rt: 0.3333},
+		},
+		{
+			"inverted",
+			ResponseMap{lx: AxisResponse{Invert: true, Sensitivity: 1}, ry: AxisResponse{Deadzone: 0.2, Invert: true, Sensitivity: 1}},
+			map[glfw.GamepadAxis]float32{lx: 0.5, ry: -0.6},
+			map[glfw.GamepadAxis]float32{lx: -0.5, ry: 0.5},
+		},
+		{
+			"axial deadzone drops a diagonal",
+			ResponseMap{lx: linear(0.2)},
+			map[glfw.GamepadAxis]float32{lx: 0.15, ly: 0.9},
+			map[glfw.GamepadAxis]float32{lx: 0, ly: 0.9},
+		},
+		{
+			"radial with an unshaped partner",
+			ResponseMap{lx: radial},
+			map[glfw.GamepadAxis]float32{lx: 0.15, ly: 0.9},
+			map[glfw.GamepadAxis]float32{lx: 0.1464, ly: 0.9},
+		},
+		{
+			"radial goes by the raw partner",
+			ResponseMap{lx: radial},
+			map[glfw.GamepadAxis]float32{lx: 0.15, ly: 0.15},
+			map[glfw.GamepadAxis]float32{lx: 0.0107, ly: 0},
+		},
+		{
+			"radial inside the deadzone",
+			ResponseMap{lx: radial, ly: radial},
+			map[glfw.GamepadAxis]float32{lx: 0.12, ly: -0.16},
+			map[glfw.GamepadAxis]float32{lx: 0, ly: 0},
+		},
+		{
+			"radial past the edge",
+			ResponseMap{lx: radial, ly: radial},
+			map[glfw.GamepadAxis]float32{lx: 0.9, ly: -0.9},
+			map[glfw.GamepadAxis]float32{lx: 0.7071, ly: -0.7071},
+		},
+		{
+			"inverted radial",
+			ResponseMap{lx: inverted},
+			map[glfw.GamepadAxis]float32{lx: 0.4, ly: 0.3},
+			map[glfw.GamepadAxis]float32{lx: -0.3, ly: 0.3},
+		},
+		{
+			"inverted radial on both axes",
+			ResponseMap{rx: inverted, ry: inverted},
+			map[glfw.GamepadAxis]float32{rx: -0.4, ry: 0.3},
+			map[glfw.GamepadAxis]float32{rx: 0.3, ry: -0.225},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			state := resting
+			for axis, value := range test.axes {
+				state.Axes[axis] = value
+			}
+			want := resting.Axes
+			for axis, value := range test.want {
+				want[axis] = value
+			}
+
+			got := test.responses.Apply(state)
+			for axis := range want {
+				if !near(got.Axes[axis], want[axis]) {
+					t.Errorf("axis %d is %g, want %g", axis, got.Axes[axis], want[axis])
+				}
+			}
+		})
+	}
+}
+
+func TestResponseDeadzoneReachesMultiplexers(t *testing.T) {
+	// A joystick shaped with a small deadzone counts as pushed even where
+	// the default deadzone would have dropped it
+	state := resting
+	state.Axes[glfw.AxisLeftX] = 0.15
+	state.Axes[glfw.AxisRightTrigger] = -0.7
+	shaped := ResponseMap{glfw.AxisLeftX: linear(0.05), glfw.AxisRightTrigger: linear(0.1)}.Apply(state)
+
+	multiplexers := []Multiplexer{
+		AverageMultiplexer{},
+		OrMultiplexer{},
+		VoteMultiplexer{DEFAULT_QUORUM},
+		StrongestMultiplexer{},
+		&FirstMultiplexer{},
+	}
+	for _, multiplexer := range multiplexers {
+		var multiplexed glfw.GamepadState
+		multiplexer.Multiplex(nil, StatesMap{{1, 0}: shaped, {2, 0}: resting}, &multiplexed)
+		for _, axis := range []glfw.GamepadAxis{glfw.AxisLeftX, glfw.AxisRightTrigger} {
+			if multiplexed.Axes[axis] == restValue(axis) {
+				t.Errorf("%T ignored axis %d shaped to %g", multiplexer, axis, shaped.Axes[axis])
+			}
+		}
+	}
+}
+
+func TestResponseConfig(t *testing.T) {
+	config, err := loadConfigString(t, `clients:
+  alice:
+    joystick0: [AXIS_LEFT_X]
+axes:
+  alice:
+    AXIS_LEFT_X:
+      deadzone: 0
+      curve: exponential
+    AXIS_LEFT_Y:
+      invert: true
+    AXIS_RIGHT_X:
+      sensitivity: 0
+    AXIS_LEFT_TRIGGER: {}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	responses := config.Profiles[DEFAULT_PROFILE].Responses["alice"]
+	tests := []struct {
+		axis glfw.GamepadAxis
+		want AxisResponse
+	}{
+		{glfw.AxisLeftX, AxisResponse{Deadzone: 0, Sensitivity: 1, Curve: CURVE_EXPONENTIAL, Exponent: DEFAULT_CURVE_EXPONENT}},
+		{glfw.AxisLeftY, AxisResponse{Deadzone: STICK_DEADZONE, Invert: true, Sensitivity: 1, Curve: CURVE_LINEAR, Exponent: DEFAULT_CURVE_EXPONENT}},
+		{glfw.AxisRightX, AxisResponse{Deadzone: STICK_DEADZONE, Sensitivity: 0, Curve: CURVE_LINEAR, Exponent: DEFAULT_CURVE_EXPONENT}},
+		{glfw.AxisLeftTrigger, AxisResponse{Deadzone: TRIGGER_DEADZONE, Sensitivity: 1, Curve: CURVE_LINEAR, Exponent: DEFAULT_CURVE_EXPONENT}},
+	}
+	for _, test := range tests {
+		if got, exists := responses[test.axis]; !exists || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("axis %d is %+v, want %+v", test.axis, got, test.want)
+		}
+	}
+
+	expectConfigErrors(t, `clients:
+  alice:
+    joystick0: [AXIS_LEFT_X]
+axes:
+  alice:
+    AXIS_LEFT_X:
+      curve: exponential
+      exponent: 0
+    AXIS_LEFT_Y:
+      deadzone: 0.7
+      outer_deadzone: 0.3
+    AXIS_RIGHT_X:
+      curve: custom
+`,
+		ConfigError{8, "exponent must be positive"},
+		ConfigError{11, "deadzone and outer deadzone leave nothing of the axis"},
+		ConfigError{12, "a custom curve needs at least 2 points"},
+	)
+}
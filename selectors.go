@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-gl/glfw/v3.3/glfw"
+)
+
+// Prefixes of the joystick selectors that follow a controller around instead
+// of sticking to wherever it's plugged in
+const (
+	SELECTOR_INDEX = "joystick"
+	SELECTOR_GUID  = "guid:"
+	SELECTOR_NAME  = "name:"
+)
+
+// JoystickSelector picks which of a client's joysticks some rules are for,
+// by where it's plugged in, by its GUID, or by a pattern matched against its
+// gamepad name like name:Xbox*. Only one of them is set
+type JoystickSelector struct {
+	Index glfw.Joystick
+	GUID  string
+	Name  string
+}
+
+// SelectorMap is the rules of a client's joysticks the way the config picks them
+type SelectorMap map[JoystickSelector][]MultiplexRule
+
+// Peripheral is a controller a client has plugged in
+type Peripheral struct {
+	Joystick uint8
+	GUID     string
+	Name     string
+}
+
+// parseSelector parses a joystick of the config like joystick0, guid:03000000... or name:Xbox*
+func parseSelector(selector string) (JoystickSelector, error) {
+	switch {
+	case strings.HasPrefix(selector, SELECTOR_GUID):
+		guid := strings.TrimPrefix(selector, SELECTOR_GUID)
+		if guid == "" {
+			return JoystickSelector{}, fmt.Errorf("%s is missing the GUID", selector)
+		}
+		return JoystickSelector{GUID: strings.ToLower(guid)}, nil
+	case strings.HasPrefix(selector, SELECTOR_NAME):
+		pattern := strings.TrimPrefix(selector, SELECTOR_NAME)
+		if _, err := path.Match(pattern, ""); pattern == "" || err != nil {
+			return JoystickSelector{}, fmt.Errorf("%s has a bad name pattern", selector)
+		}
+		return JoystickSelector{Name: pattern}, nil
+	case strings.HasPrefix(selector, SELECTOR_INDEX):
+		joystick, err := strconv.Atoi(strings.TrimPrefix(selector, SELECTOR_INDEX))
+		if err != nil || joystick < int(glfw.Joystick1) || joystick > int(glfw.JoystickLast) {
+			return JoystickSelector{}, fmt.Errorf("joystick number of %s must be from 0 to %d", selector, glfw.JoystickLast)
+		}
+		return JoystickSelector{Index: glfw.Joystick(joystick)}, nil
+	}
+
+	return JoystickSelector{}, fmt.Errorf("joysticks are picked by joystick<number>, guid:<guid> or name:<pattern>, got %s", selector)
+}
+
+// String is the selector the way the config writes it
+func (s JoystickSelector) String() string {
+	if s.GUID != "" {
+		return SELECTOR_GUID + s.GUID
+	}
+	if s.Name != "" {
+		return SELECTOR_NAME + s.Name
+	}
+	return fmt.Sprintf("%s%d", SELECTOR_INDEX, s.Index)
+}
+
+// Resolve works out the rules of each joystick from the controllers the
+// client has plugged in. A GUID beats a name which beats where the controller
+// is plugged in, and joysticks nothing was said about only go by where they are.
+// A GUID or name only picks one controller, when several fit it goes to the
+// lowest joystick and the others look for the next best fit
+func (selectors SelectorMap) Resolve(peripherals map[uint8]Peripheral) RulesMap {
+	rules := make(RulesMap)
+	for selector, array := range selectors {
+		if selector.GUID == "" && selector.Name == "" {
+			rules[selector.Index] = array
+		}
+	}
+
+	joysticks := make([]int, 0, len(peripherals))
+	for joystick := range peripherals {
+		joysticks = append(joysticks, int(joystick))
+	}
+	sort.Ints(joysticks)
+
+	taken := make(map[JoystickSelector]bool)
+	for _, joystick := range joysticks {
+		if selector, found := selectors.match(peripherals[uint8(joystick)], taken); found {
+			taken[selector] = true
+			rules[glfw.Joystick(joystick)] = selectors[selector]
+		}
+	}
+
+	return rules
+}
+
+// match finds the selector that fits a controller best, leaving out the ones
+// already taken. When several name patterns fit the longest one wins, so the
+// same one is picked every time
+func (selectors SelectorMap) match(peripheral Peripheral, taken map[JoystickSelector]bool) (best JoystickSelector, found bool) {
+	for selector := range selectors {
+		if taken[selector] {
+			continue
+		}
+		if selector.GUID != "" && strings.EqualFold(selector.GUID, peripheral.GUID) {
+			return selector, true
+		}
+		if selector.Name == "" {
+			continue
+		}
+		if matched, _ := path.Match(selector.Name, peripheral.Name); !matched {
+			continue
+		}
+		if !found || len(selector.Name) > len(best.Name) ||
+			len(selector.Name) == len(best.Name) && selector.Name < best.Name {
+			best, found = selector, true
+		}
+	}
+	return best, found
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-gl/glfw/v3.3/glfw"
+)
+
+func TestResolve(t *testing.T) {
+	a := []MultiplexRule{{Button, glfw.ButtonA, 0}}
+	b := []MultiplexRule{{Button, glfw.ButtonB, 0}}
+	x := []MultiplexRule{{Button, glfw.ButtonX, 0}}
+	y := []MultiplexRule{{Button, glfw.ButtonY, 0}}
+	pad := Peripheral{GUID: "030000005e0400008e02000010010000", Name: "Xbox 360 Controller"}
+	on := func(joystick uint8, peripheral Peripheral) Peripheral {
+		peripheral.Joystick = joystick
+		return peripheral
+	}
+
+	tests := []struct {
+		name        string
+		selectors   SelectorMap
+		peripherals []Peripheral
+		want        map[glfw.Joystick]glfw.GamepadButton
+	}{
+		{
+			"guid beats name beats index",
+			SelectorMap{{Index: 0}: a, {Name: "Xbox*"}: b, {GUID: pad.GUID}: x},
+			[]Peripheral{on(0, pad)},
+			map[glfw.Joystick]glfw.GamepadButton{0: glfw.ButtonX},
+		},
+		{
+			"rules follow the controller",
+			SelectorMap{{Index: 0}: a, {GUID: pad.GUID}: x},
+			[]Peripheral{on(3, pad)},
+			map[glfw.Joystick]glfw.GamepadButton{0: glfw.ButtonA, 3: glfw.ButtonX},
+		},
+		{
+			"longest name pattern wins",
+			SelectorMap{{Name: "Xbox*"}: b, {Name: "Xbox 360*"}: y},
+			[]Peripheral{on(1, pad)},
+			map[glfw.Joystick]glfw.GamepadButton{1: glfw.ButtonY},
+		},
+		{
+			"identical pads only take a guid once",
+			SelectorMap{{GUID: pad.GUID}: x},
+			[]Peripheral{on(4, pad), on(2, pad)},
+			map[glfw.Joystick]glfw.GamepadButton{2: glfw.ButtonX},
+		},
+		{
+			"the other identical pad goes by what fits next",
+			SelectorMap{{Index: 4}: a, {GUID: pad.GUID}: x, {Name: "Xbox*"}: b},
+			[]Peripheral{on(4, pad), on(2, pad), on(7, pad)},
+			map[glfw.Joystick]glfw.GamepadButton{2: glfw.ButtonX, 4: glfw.ButtonB},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			peripherals := make(map[uint8]Peripheral)
+			for _, peripheral := range test.peripherals {
+				peripherals[peripheral.Joystick] = peripheral
+			}
+			rules := test.selectors.Resolve(peripherals)
+			if len(rules) != len(test.want) {
+				t.Fatalf("resolved %v, want %v", rules, test.want)
+			}
+			for joystick, button := range test.want {
+				if len(rules[joystick]) != 1 || rules[joystick][0].Button != button {
+					t.Errorf("joystick %d has %v, want %d", joystick, rules[joystick], button)
+				}
+			}
+		})
+	}
+}
@@ -1,107 +1,175 @@
 package main
 
 import (
+	"crypto/cipher"
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"github.com/go-gl/glfw/v3.3/glfw"
 	"log"
 	"net"
+	"reflect"
+	"sync"
+	"time"
 )
 
-func controlError(conn net.Conn, msg string) {
+// controlError tells the client what went wrong and hangs up on them
+func controlError(conn *ControlStream, msg string) error {
 	errMsg := (&ControlProtocol{}).Error(msg)
 	conn.Write(errMsg)
 	conn.Close()
+	return errors.New(msg)
 }
 
 func (c *ServerConn) Handshake() error {
-	// Create a buffer
-	buf := make([]byte, 1024)
-
-	// Read in data
-	_, err := c.Conn.Read(buf)
+	// Read in the first packet
+	pkt, err := c.Conn.ReadPacket()
 	if err != nil {
 		log.Printf("Failed to read from client %s with error: %s", c.Conn.RemoteAddr().String(),
 			err.Error())
+		if errors.Is(err, ErrFrameTooLarge) {
+			return controlError(c.Conn, "Invalid packet, expecting type REGISTER followed by a name")
+		}
+		c.Conn.Close()
 		return err
 	}
-
-	pkt := &ControlProtocol{}
-	err = pkt.Parse(buf)
-	if err != nil {
-		controlError(c.Conn, "Invalid packet, expecting type REGISTER followed by a name")
-		return err
+	// Clients coming back after losing the connection send RESUME instead
+	var version uint8
+	var capabilities uint32
+	var name string
+	var resume *SessionToken
+	if pkt.Type == RESUME {
+		resume = &SessionToken{}
+		version, capabilities, *resume, name, err = pkt.ParseResume()
+	} else {
+		version, capabilities, name, err = pkt.ParseRegister()
 	}
-	if pkt.Type != REGISTER {
-		controlError(c.Conn, "Invalid packet, expecting type REGISTER followed by a name")
-		return err
+	if err != nil {
+		return controlError(c.Conn, "Invalid packet, expecting type REGISTER followed by a name")
 	}
 
-	// Get the client name
-	name := string(pkt.Data)
+	// Agree on a protocol version and features, or turn away clients that are too old
+	c.Version, c.Capabilities, err = negotiate(version, capabilities)
+	c.negotiation = Negotiation{version, capabilities, c.Version, c.Capabilities}
+	if err == nil && c.Security.Required && c.Capabilities&CAP_ENCRYPTION == 0 {
+		err = errors.New("this server only accepts encrypted connections, please update")
+	}
+	if err != nil {
+		log.Printf("Rejected client %s: %s\n", c.Conn.RemoteAddr().String(), err.Error())
+		return controlError(c.Conn, err.Error())
+	}
 
 	// See if it's a valid name
-	if !namePattern.Match(pkt.Data) {
+	if !namePattern.MatchString(name) {
 		// Invalid name, tell them that and die
-		controlError(c.Conn, "Invalid name")
-		return err
+		return controlError(c.Conn, "Invalid name")
 	}
 
 	// Loop through clients to see if this name already exists
 	// This is only done on connect so that the map will mostly be used efficiently by id
 	// We just haven't gotten to this step yet, so we can't do that
 	clientLock.Lock()
+	var held *ServerConn
 	for _, client := range clients {
-		// Kill the connection if the name already exists
-		if client.Name == name {
-			controlError(c.Conn, "Name already taken, please try something else")
-			// Remember to unlock
-			clientLock.Unlock()
-			return err
+		if client.Name != name {
+			continue
+		}
+		// A client coming back with the right token gets its old slot, even
+		// when its old connection died without the server noticing yet
+		if resume != nil && client.resumeToken != (SessionToken{}) &&
+			subtle.ConstantTimeCompare(resume[:], client.resumeToken[:]) == 1 {
+			held = client
+			continue
 		}
+		// Kill the connection if the name already exists
+		// Remember to unlock
+		clientLock.Unlock()
+		return controlError(c.Conn, "Name already taken, please try something else")
 	}
 
-	// Now try to find a new valid id
-	for c.Id = 0; c.Id < 255; c.Id++ {
-		_, exists := clients[c.Id]
-		if !exists {
-			break
+	stale := false
+	if held != nil {
+		// Take over the old id, the old UDP address goes with the old session
+		c.Id = held.Id
+		stale = !held.held
+		for addr, client := range packetConnections {
+			if client == held {
+				delete(packetConnections, addr)
+			}
+		}
+		log.Printf("Client %s resumed its session as id %d\n", name, c.Id)
+	} else {
+		// Now try to find a new valid id
+		for c.Id = 0; c.Id < 255; c.Id++ {
+			_, exists := clients[c.Id]
+			if !exists {
+				break
+			}
 		}
 	}
 
+	// Create the session token the client has to put in every gamestate packet
+	c.Token, err = newToken()
+	if err != nil {
+		clientLock.Unlock()
+		return controlError(c.Conn, "Server failed to create a session")
+	}
+
 	// Create the client in the map
+	c.Name = name
 	clients[c.Id] = c
 
 	// Unlock since we are done with the map
 	clientLock.Unlock()
 
+	// The old connection is dead even if it hasn't timed out yet, and it
+	// can't take the session back with it now that the id is ours
+	if stale {
+		held.Conn.Close()
+	}
+
 	// Tell the client of their id
-	_, err = c.Conn.Write(pkt.SetId(c.Id))
+	err = c.Conn.Write(pkt.SetId(c.Id, c.Version, c.Capabilities, c.Token))
 	if err != nil {
 		log.Printf(
 			"Could not send packet to client %s due to error: %s\n",
 			c.Conn.RemoteAddr().String(),
 			err.Error(),
 		)
-		clientLock.Lock()
-		delete(clients, c.Id)
-		clientLock.Unlock()
+		c.Conn.Close()
+		c.remove()
 		return err
 	}
 
+	// Everything after the id is encrypted when both sides can
+	if c.Capabilities&CAP_ENCRYPTION != 0 {
+		err = c.exchangeKeys()
+		if err != nil {
+			log.Printf(
+				"Key exchange with client %s failed due to error: %s\n",
+				c.Conn.RemoteAddr().String(),
+				err.Error(),
+			)
+			c.remove()
+			return controlError(c.Conn, ErrKeyExchange.Error())
+		}
+	}
+
 	// Get the client configuration
-	joystickRules, exists := c.Rules[name]
+	clientLock.Lock()
+	_, exists := c.Rules[name]
+	c.resolveRules()
+	joystickRules := c.resolved
+	clientLock.Unlock()
 	if !exists {
+		c.remove()
 		// Tell the client they don't have a configuration
-		controlError(c.Conn, "Configuration doesn't exist for name "+name)
-		clientLock.Lock()
-		delete(clients, c.Id)
-		clientLock.Unlock()
-		return err
+		return controlError(c.Conn, "Configuration doesn't exist for name "+name)
 	}
 
 	// Send over the rules
 	conf := joystickRules.Bytes()
-	_, err = c.Conn.Write(pkt.Configure(conf))
+	err = c.Conn.Write(pkt.Configure(conf))
 
 	// Complain on error
 	if err != nil {
@@ -110,11 +178,72 @@ func (c *ServerConn) Handshake() error {
 			c.Conn.RemoteAddr().String(),
 			err.Error(),
 		)
+		c.Conn.Close()
+		c.remove()
+		return err
+	}
+
+	// Give newer clients a way back into the session if the connection drops
+	if c.Version >= RESUME_PROTOCOL_VERSION {
+		resumeToken, err := newToken()
+		if err != nil {
+			c.remove()
+			return controlError(c.Conn, "Server failed to create a session")
+		}
 		clientLock.Lock()
-		delete(clients, c.Id)
+		c.resumeToken = resumeToken
 		clientLock.Unlock()
+
+		err = c.Conn.Write(pkt.ResumeToken(resumeToken))
+		if err != nil {
+			log.Printf(
+				"Could not send packet to client %s due to error: %s\n",
+				c.Conn.RemoteAddr().String(),
+				err.Error(),
+			)
+			c.Conn.Close()
+			c.remove()
+			return err
+		}
+	}
+
+	// The client can play now
+	clientLock.Lock()
+	c.Ready = true
+	clientLock.Unlock()
+	return nil
+}
+
+// exchangeKeys runs the server's side of the X25519 key exchange and
+// encrypts the control socket and gamestate packets with the result
+func (c *ServerConn) exchangeKeys() error {
+	// The client goes first
+	pkt, err := c.Conn.ReadPacket()
+	if err != nil {
+		return err
+	}
+	if pkt.Type != KEY_EXCHANGE {
+		return errors.New("expecting a KEY_EXCHANGE packet")
+	}
+
+	keys, err := newKeyPair()
+	if err != nil {
+		return err
+	}
+	session, err := deriveKeys(keys, pkt.Data, pkt.Data, keys.Public, c.Token, c.Security.Secret, c.negotiation)
+	if err != nil {
+		return err
+	}
+
+	err = c.Conn.Write(pkt.KeyExchange(keys.Public))
+	if err != nil {
 		return err
 	}
+
+	c.Conn.Encrypt(session.ServerControl, session.ClientControl)
+	clientLock.Lock()
+	c.datagramCipher = session.ClientDatagram
+	clientLock.Unlock()
 	return nil
 }
 
@@ -127,89 +256,499 @@ func (c *ServerConn) ControlSocket(port uint16) {
 		return
 	}
 
-	pkt := &ControlProtocol{}
+	// Newer clients ping back and forth, so a silent client is a dead one
+	heartbeat := c.Version >= HEARTBEAT_PROTOCOL_VERSION
+	if heartbeat {
+		go c.Link.Ping(c.Conn)
+	}
+
 	// Wait for joystick peripheral announcements
 	for {
-		buf := make([]byte, 512)
-		_, err := c.Conn.Read(buf)
+		if heartbeat {
+			c.Conn.SetReadDeadline(time.Now().Add(HEARTBEAT_TIMEOUT))
+		}
+		pkt, err := c.Conn.ReadPacket()
 		if err != nil {
 			log.Printf(
 				"Could not read packet from client %s due to error: %s\n",
 				c.Conn.RemoteAddr().String(),
 				err.Error(),
 			)
+			// A broken frame can't be recovered from, the stream is out of line
+			if errors.Is(err, ErrFrameTooLarge) {
+				controlError(c.Conn, "Invalid packet")
+				c.remove()
+			} else {
+				// The connection may have just dropped, give the client a chance to come back
+				c.Conn.Close()
+				c.hold()
+			}
+			return
+		}
+
+		if pkt.Type == PING {
+			c.Conn.Write(pkt.Pong(pkt))
+		} else if pkt.Type == PONG {
+			c.Link.Pong(pkt)
+		} else if pkt.Type == PERIPHERAL_CONNECT {
+			peripheral, err := pkt.ParsePeripheralConnect()
+			if err != nil || glfw.Joystick(peripheral.Joystick) > glfw.JoystickLast {
+				log.Printf("Client %s sent a bad peripheral\n", c.Name)
+				continue
+			}
+			log.Printf("Client %s plugged in %s as joystick %d\n", c.Name, peripheral.Name, peripheral.Joystick)
+			clientLock.Lock()
+			if c.peripherals == nil {
+				c.peripherals = make(map[uint8]Peripheral)
+			}
+			c.peripherals[peripheral.Joystick] = peripheral
+			clientLock.Unlock()
+			c.refreshRules()
+		} else if pkt.Type == PERIPHERAL_DISCONNECT {
+			joystick, err := pkt.ParsePeripheralDisconnect()
+			if err != nil {
+				log.Printf("Client %s sent a bad peripheral\n", c.Name)
+				continue
+			}
+			log.Printf("Client %s unplugged joystick %d\n", c.Name, joystick)
 			clientLock.Lock()
-			delete(clients, c.Id)
+			delete(c.peripherals, joystick)
 			clientLock.Unlock()
+			c.refreshRules()
+		} else if pkt.Type == DONE {
+			// Close the connection, the client said they're done
+			c.Conn.Close()
+			c.remove()
 			return
 		}
+	}
+}
 
-		// Parse the packet and complain on failure, but don't close the connection
-		err = pkt.Parse(buf)
-		if err != nil {
-			controlError(c.Conn, "Invalid packet")
+// connectedRules collects the rules of every joystick of every connected client
+func connectedRules() InputRules {
+	rules := make(InputRules)
+
+	clientLock.Lock()
+	defer clientLock.Unlock()
+	for id, client := range clients {
+		if !client.Ready {
 			continue
 		}
+		for device, joystickRules := range client.resolved {
+			rules[InputId{id, device}] = joystickRules
+		}
+	}
 
-		if pkt.Type == PERIPHERAL_CONNECT || pkt.Type == PERIPHERAL_DISCONNECT {
-			// Print out what the peripheral event was
-			log.Println(string(pkt.Data))
-		} else if pkt.Type == DONE {
-			// Close the connection, the client said they're done
-			c.Conn.Close()
-			clientLock.Lock()
-			delete(clients, c.Id)
-			clientLock.Unlock()
-			return
+	return rules
+}
+
+// The turn change waiting to be sent. A single goroutine sends them so a
+// client never hears about a turn before the one it came after, and changes
+// that pile up while it's stuck on a slow client are merged into one
+var (
+	turnLock    sync.Mutex
+	pendingTurn [2]int
+	turnPending bool
+	turnWaiting = make(chan struct{}, 1)
+	turnSender  sync.Once
+)
+
+// notifyTurn queues telling the clients their turn ended and started, without
+// ever waiting on them
+func notifyTurn(prev, next int) {
+	turnSender.Do(func() { go sendTurns() })
+
+	turnLock.Lock()
+	// Whoever had the turn before the changes that weren't sent yet still
+	// has to hear it's over
+	if turnPending {
+		prev = pendingTurn[0]
+	}
+	pendingTurn = [2]int{prev, next}
+	turnPending = true
+	turnLock.Unlock()
+
+	select {
+	case turnWaiting <- struct{}{}:
+	default:
+	}
+}
+
+// sendTurns tells the clients about the latest turn change whenever there is one
+func sendTurns() {
+	for range turnWaiting {
+		turnLock.Lock()
+		change := pendingTurn
+		pending := turnPending
+		turnPending = false
+		turnLock.Unlock()
+
+		// The turn can come back around to who had it before they heard it left
+		if pending && change[0] != change[1] {
+			sendTurn(change[0], change[1])
 		}
 	}
 }
 
+// sendTurn tells the clients when their turn ends and starts
+func sendTurn(prev, next int) {
+	clientLock.Lock()
+	prevClient := clients[uint8(prev)]
+	nextClient := clients[uint8(next)]
+	if prevClient != nil && !prevClient.Ready {
+		prevClient = nil
+	}
+	if nextClient != nil && !nextClient.Ready {
+		nextClient = nil
+	}
+	clientLock.Unlock()
+
+	pkt := &ControlProtocol{}
+	if prev != -1 && prevClient != nil {
+		log.Printf("Turn over for %s\n", prevClient.Name)
+		prevClient.Conn.Write(pkt.TurnEnd())
+	}
+	if next != -1 && nextClient != nil {
+		log.Printf("Turn started for %s\n", nextClient.Name)
+		nextClient.Conn.Write(pkt.TurnStart())
+	}
+}
+
+// SendRumble asks the client to rumble one of its joysticks, or all of them
+// with ALL_JOYSTICKS. Clients that can't rumble are skipped
+func (c *ServerConn) SendRumble(joystick uint8, effect Rumble) error {
+	if c.Capabilities&CAP_RUMBLE == 0 {
+		return nil
+	}
+	return c.Conn.Write((&ControlProtocol{}).Rumble(joystick, effect))
+}
+
+// Kick ends the client's session for good, it isn't held for them to come back to
+func (c *ServerConn) Kick(reason string) {
+	log.Printf("Kicking %s: %s\n", c.Name, reason)
+	c.remove()
+	c.Conn.Write((&ControlProtocol{}).Done(reason))
+	c.Conn.Close()
+}
+
+// resolveRules works out the rules of the client's joysticks from the
+// controllers it has plugged in and returns whether they changed.
+// clientLock has to be held
+func (c *ServerConn) resolveRules() bool {
+	resolved := c.Rules[c.Name].Resolve(c.peripherals)
+	changed := !reflect.DeepEqual(resolved, c.resolved)
+	c.resolved = resolved
+	return changed
+}
+
+// refreshRules works out the client's rules again and sends them over if they changed
+func (c *ServerConn) refreshRules() {
+	clientLock.Lock()
+	changed := c.resolveRules()
+	clientLock.Unlock()
+
+	if changed {
+		c.sendRules()
+	}
+}
+
+// sendRules sends the client the rules of its joysticks once it's ready for them
+func (c *ServerConn) sendRules() {
+	clientLock.Lock()
+	ready := c.Ready
+	joystickRules := c.resolved
+	clientLock.Unlock()
+
+	if ready {
+		log.Printf("Sending new rules to %s\n", c.Name)
+		c.Conn.Write((&ControlProtocol{}).Configure(joystickRules.Bytes()))
+	}
+}
+
+// setRules changes the rules of a client, and sends them over if it's connected.
+// Every session shares the same ClientsMap so changing it once changes it everywhere
+func setRules(rules ClientsMap, name string, selectors SelectorMap) {
+	clientLock.Lock()
+	rules[name] = selectors
+	var connected []*ServerConn
+	for _, client := range clients {
+		if client.Name == name {
+			connected = append(connected, client)
+		}
+	}
+	clientLock.Unlock()
+
+	for _, client := range connected {
+		client.refreshRules()
+	}
+}
+
+// swapRules swaps in the rules of a new config and works out every client's
+// rules again, without telling anyone. It returns the clients whose rules
+// changed and the ones that were left out, who have no rules left
+func swapRules(rules ClientsMap, updated ClientsMap) (changed, removed []*ServerConn) {
+	clientLock.Lock()
+	defer clientLock.Unlock()
+	for name := range rules {
+		if _, exists := updated[name]; !exists {
+			delete(rules, name)
+		}
+	}
+	for name, selectors := range updated {
+		rules[name] = selectors
+	}
+
+	for _, client := range clients {
+		if _, exists := rules[client.Name]; !exists {
+			client.resolveRules()
+			removed = append(removed, client)
+		} else if client.resolveRules() {
+			changed = append(changed, client)
+		}
+	}
+	return changed, removed
+}
+
+// replaceResponses swaps in how clients shape their axes from a new config.
+// Every session shares the same ClientResponses, the next packets use them
+func replaceResponses(responses ClientResponses, updated ClientResponses) {
+	clientLock.Lock()
+	defer clientLock.Unlock()
+	for name := range responses {
+		delete(responses, name)
+	}
+	for name, response := range updated {
+		responses[name] = response
+	}
+}
+
+// broadcastRumble rumbles every joystick of every client
+func broadcastRumble(effect Rumble) {
+	clientLock.Lock()
+	ready := make([]*ServerConn, 0, len(clients))
+	for _, client := range clients {
+		if client.Ready {
+			ready = append(ready, client)
+		}
+	}
+	clientLock.Unlock()
+
+	for _, client := range ready {
+		client.SendRumble(ALL_JOYSTICKS, effect)
+	}
+}
+
+// remove forgets about a client so its id and UDP address can't be used anymore
+func (c *ServerConn) remove() {
+	clientLock.Lock()
+	// The id might already belong to someone else
+	owned := clients[c.Id] == c
+	if owned {
+		delete(clients, c.Id)
+	}
+	for addr, client := range packetConnections {
+		if client == c {
+			delete(packetConnections, addr)
+		}
+	}
+	clientLock.Unlock()
+
+	// Let go of everything the client's joysticks were pressing
+	if owned {
+		forgetStates(c.Id)
+	}
+}
+
+// live checks that the client's id still belongs to this session
+func (c *ServerConn) live() bool {
+	clientLock.Lock()
+	defer clientLock.Unlock()
+	return clients[c.Id] == c
+}
+
+// hold keeps the client's id for the grace period after its control socket
+// drops, so it can come back with its resume token and pick up where it left off
+func (c *ServerConn) hold() {
+	if c.Grace <= 0 || c.Version < RESUME_PROTOCOL_VERSION {
+		c.remove()
+		return
+	}
+
+	clientLock.Lock()
+	if clients[c.Id] != c {
+		clientLock.Unlock()
+		return
+	}
+	c.Ready = false
+	c.held = true
+	for addr, client := range packetConnections {
+		if client == c {
+			delete(packetConnections, addr)
+		}
+	}
+	clientLock.Unlock()
+
+	// Nobody is pressing anything while the client is gone
+	forgetStates(c.Id)
+
+	log.Printf("Holding id %d for %s for %s in case they come back\n", c.Id, c.Name, c.Grace)
+	time.AfterFunc(c.Grace, func() {
+		clientLock.Lock()
+		expired := clients[c.Id] == c
+		clientLock.Unlock()
+
+		if expired {
+			log.Printf("%s didn't come back, freeing id %d\n", c.Name, c.Id)
+			c.remove()
+		}
+	})
+}
+
+// forgetStates lets go of every joystick of a client
+func forgetStates(client uint8) {
+	events <- Event{Kind: EVENT_FORGET, Client: client}
+}
+
+// sessionFor finds the live session a gamestate packet belongs to. The packet
+// has to carry the session's token and come from the same host as the control
+// socket. The first good packet binds the session to its UDP address
+func sessionFor(pkt *GamestateProtocol, raddr net.Addr) *ServerConn {
+	clientLock.Lock()
+	defer clientLock.Unlock()
+
+	c, exists := clients[pkt.ClientId]
+	if !exists || !c.Ready || subtle.ConstantTimeCompare(pkt.Token[:], c.Token[:]) != 1 {
+		return nil
+	}
+
+	if bound, exists := packetConnections[raddr.String()]; exists {
+		if bound != c {
+			return nil
+		}
+		return c
+	}
+
+	// Only one UDP address per session
+	if c.DatagramAddr != nil {
+		return nil
+	}
+
+	// The datagrams have to come from the same machine as the control socket
+	udpAddr, ok := raddr.(*net.UDPAddr)
+	tcpAddr, ok2 := c.Conn.RemoteAddr().(*net.TCPAddr)
+	if !ok || !ok2 || !udpAddr.IP.Equal(tcpAddr.IP) {
+		return nil
+	}
+
+	c.DatagramAddr = raddr
+	packetConnections[raddr.String()] = c
+	return c
+}
+
+// parseGamestate parses a gamestate packet, which has to be sealed with the
+// session's key if the client agreed to encryption and compressed if it agreed
+// to compression
+func parseGamestate(pkt *GamestateProtocol, data []byte) error {
+	if len(data) < gamestateHeaderLen {
+		return errors.New("invalid packet length")
+	}
+
+	clientLock.Lock()
+	c, exists := clients[data[4]]
+	var aead cipher.AEAD
+	encrypted := exists && c.Capabilities&CAP_ENCRYPTION != 0
+	if encrypted {
+		aead = c.datagramCipher
+	}
+	pkt.Compressed = exists && c.Capabilities&CAP_COMPRESSION != 0
+	clientLock.Unlock()
+
+	if !encrypted {
+		return pkt.Parse(data)
+	}
+	if aead == nil {
+		return errors.New("keys have not been exchanged yet")
+	}
+	return pkt.Open(aead, data)
+}
+
+// fresh checks a gamestate packet is newer than every packet before it and
+// counts it. Replayed packets still open with the session's key, this is what
+// drops them. Only the UDP listener touches the counter
+func (c *ServerConn) fresh(pkt *GamestateProtocol) bool {
+	if pkt.PacketId <= c.lastPacketId {
+		return false
+	}
+	c.Link.Packet(pkt.PacketId, c.lastPacketId)
+	c.lastPacketId = pkt.PacketId
+	return true
+}
+
 func udpListener(serv net.PacketConn) {
-	counter := make(map[string]uint32)
-	// Make a buffer for the size of the packet we expect
+	// Leave room to notice packets that are too long
+	buf := make([]byte, 2*GamestatePacketLen+sealOverhead)
 	for {
-		buf := make([]byte, GamestatePacketLen)
 		// Read in the data
-		_, raddr, err := serv.ReadFrom(buf)
+		n, raddr, err := serv.ReadFrom(buf)
 		if err != nil {
-			log.Fatalf("Failed to read from %s socket due to error: %s", raddr.Network(), err)
+			log.Fatalf("Failed to read from udp socket due to error: %s", err)
 		}
 
-		ip := raddr.String()
-
-		// Parse the packet
+		// Parse the packet, opening it if the client encrypts
 		pkt := &GamestateProtocol{}
-		err = pkt.Parse(buf)
+		err = parseGamestate(pkt, buf[:n])
 
-		// If the packet is bad or old just ignore it
+		// If the packet is bad just ignore it
 		if err != nil {
 			continue
 		}
 
-		// TODO actually check to make sure this is a real client
-		// See if this client doesn't exist or it's an old packet
-		// if c, exists := counter[ip]; !exists || pkt.PacketId < c {
-		// 	continue
-		// }
+		// Drop anything that doesn't belong to a live session
+		c := sessionFor(pkt, raddr)
+		if c == nil {
+			continue
+		}
 
-		// Make sure the packet isn't old
-		if pkt.PacketId < counter[ip] {
+		// Joysticks are numbered the same way glfw does on the client
+		if glfw.Joystick(pkt.DeviceId) > glfw.JoystickLast {
 			continue
 		}
 
-		// Up the packet counter
-		counter[ip] += 1
+		// Every joystick shares the counter, so packets are counted even when
+		// they're ignored or the ones skipped would look lost
+		if !c.fresh(pkt) {
+			continue
+		}
 
-		// TODO Check client rules to validate client
-		// Multiplex the rules
-		gamestateLock.Lock()
-		gamepadStates[glfw.Joystick(pkt.JoystickId)] = pkt.GamepadState
-		gamestateLock.Unlock()
+		// Ignore joysticks the client wasn't given any inputs for
+		device := glfw.Joystick(pkt.DeviceId)
+		clientLock.Lock()
+		allowed := c.resolved[device]
+		response := c.Responses[c.Name]
+		clientLock.Unlock()
+		if len(allowed) == 0 {
+			continue
+		}
+
+		// Fill in what a compressed packet left out
+		if pkt.Compressed && !c.deltas.Decode(pkt) {
+			continue
+		}
+
+		// Clients send their raw state, shape it the way the config says and
+		// only keep what they're allowed to touch
+		shaped := response.Apply(pkt.GamepadState)
+		events <- Event{
+			Kind:     EVENT_GAMESTATE,
+			Id:       InputId{pkt.ClientId, device},
+			State:    mask(shaped, allowed),
+			Unmasked: shaped,
+			Session:  c,
+		}
 	}
 }
 
-func listen(host string, port uint16, rules ClientsMap) {
+func listen(host string, port uint16, rules ClientsMap, responses ClientResponses, security Security, grace time.Duration) {
 	// Create the global UDP listener to handle all clients
 	udpServ, err := net.ListenPacket("udp", fmt.Sprintf("%s:%d", host, port))
 	if err != nil {
@@ -233,8 +772,11 @@ func listen(host string, port uint16, rules ClientsMap) {
 		}
 		// Create the client
 		client := ServerConn{
-			Conn:  conn,
-			Rules: rules,
+			Conn:      NewControlStream(conn),
+			Rules:     rules,
+			Responses: responses,
+			Security:  security,
+			Grace:     grace,
 		}
 		// Handle the controlSocket and die if it's bad
 		go client.ControlSocket(port)
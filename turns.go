@@ -0,0 +1,181 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-gl/glfw/v3.3/glfw"
+)
+
+// TurnMultiplexer lets a single client drive the virtual gamepad at a time.
+// The turn passes to the next client when TurnLength runs out, when the
+// client holding the turn presses every button in Chord, when an admin
+// asks for it or when the client goes away. Clients take turns in order of their id
+type TurnMultiplexer struct {
+	TurnLength time.Duration
+	Chord      []glfw.GamepadButton
+	// OnTurn gets called whenever the turn moves from one client to another.
+	// prev or next is -1 when there was or is nobody holding the turn. It's
+	// called in order by whoever is multiplexing, so it shouldn't block
+	OnTurn func(prev, next int)
+
+	lock      sync.Mutex
+	current   int
+	started   time.Time
+	chordHeld bool
+	chorded   bool
+	skip      bool
+	requested int
+	// Joysticks the server stopped hearing from
+	quiet map[InputId]bool
+}
+
+func newTurnMultiplexer(turnLength time.Duration, chord []glfw.GamepadButton) *TurnMultiplexer {
+	return &TurnMultiplexer{
+		TurnLength: turnLength,
+		Chord:      chord,
+		current:    -1,
+		requested:  -1,
+	}
+}
+
+// Pass moves the turn to the next client the next time the gamepads are multiplexed
+func (m *TurnMultiplexer) Pass() {
+	m.lock.Lock()
+	m.skip = true
+	m.lock.Unlock()
+}
+
+// Give moves the turn to a specific client the next time the gamepads are multiplexed
+func (m *TurnMultiplexer) Give(client uint8) {
+	m.lock.Lock()
+	m.requested = int(client)
+	m.lock.Unlock()
+}
+
+// Current returns the client holding the turn, or -1 if nobody is
+func (m *TurnMultiplexer) Current() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.current
+}
+
+func (m *TurnMultiplexer) Multiplex(
+	rules InputRules,
+	states StatesMap,
+	multiplexed *glfw.GamepadState,
+) {
+	m.lock.Lock()
+
+	// Every client with a joystick that has at least one rule and is still
+	// sending can take a turn, the joysticks of the client holding the turn
+	// get merged together
+	players := make([]int, 0, len(states))
+	current := make(StatesMap)
+	for id, state := range states {
+		if len(joystickRules(rules, id)) == 0 || m.quiet[id] {
+			continue
+		}
+		if !contains(players, int(id.Client)) {
+			players = append(players, int(id.Client))
+		}
+		if int(id.Client) == m.current {
+			current[id] = state
+		}
+	}
+	sort.Ints(players)
+
+	AverageMultiplexer{}.Multiplex(rules, current, multiplexed)
+	holder := m.current
+
+	if m.requested != -1 && contains(players, m.requested) {
+		// An admin picked who goes next
+		m.handoff(m.requested)
+	} else if m.skip || !contains(players, m.current) {
+		// An admin skipped this client or they left
+		m.handoff(nextPlayer(players, m.current))
+	} else if m.TurnLength > 0 && time.Since(m.started) >= m.TurnLength {
+		// Out of time
+		m.handoff(nextPlayer(players, m.current))
+	} else if m.chorded {
+		// The client asked to pass the turn
+		m.handoff(nextPlayer(players, m.current))
+	}
+	m.skip = false
+	m.chorded = false
+	m.requested = -1
+	next := m.current
+	onTurn := m.OnTurn
+	m.lock.Unlock()
+
+	// The new client starts driving the next time around
+	if next != holder {
+		rest(multiplexed)
+		if onTurn != nil {
+			onTurn(holder, next)
+		}
+	}
+}
+
+// WatchChord checks if a joystick of the client holding the turn just started
+// holding every button of the chord, and passes the turn the next time the
+// gamepads are multiplexed. It's given the joysticks before they're masked to
+// their rules, so passing the turn doesn't take a rule for the chord buttons
+func (m *TurnMultiplexer) WatchChord(unmasked StatesMap) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if len(m.Chord) == 0 {
+		return
+	}
+
+	held := false
+	for id, state := range unmasked {
+		if int(id.Client) != m.current {
+			continue
+		}
+		held = held || allPressed(state, m.Chord)
+	}
+
+	// Only pass the turn once per press of the chord
+	m.chorded = m.chorded || held && !m.chordHeld
+	m.chordHeld = held
+}
+
+// WatchQuiet takes the joysticks the server stopped hearing from. A client
+// whose joysticks all went quiet loses the turn the next time the gamepads
+// are multiplexed instead of keeping it until it's forgotten
+func (m *TurnMultiplexer) WatchQuiet(quiet map[InputId]bool) {
+	m.lock.Lock()
+	m.quiet = quiet
+	m.lock.Unlock()
+}
+
+func (m *TurnMultiplexer) handoff(next int) {
+	m.current = next
+	m.started = time.Now()
+	// The chord has to be released and pressed again by the next client
+	m.chordHeld = true
+}
+
+// nextPlayer finds who goes after current, wrapping around to the first client
+func nextPlayer(players []int, current int) int {
+	if len(players) == 0 {
+		return -1
+	}
+	for _, id := range players {
+		if id > current {
+			return id
+		}
+	}
+	return players[0]
+}
+
+func contains(players []int, id int) bool {
+	for _, player := range players {
+		if player == id {
+			return true
+		}
+	}
+	return false
+}
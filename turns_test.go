@@ -0,0 +1,183 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-gl/glfw/v3.3/glfw"
+)
+
+func TestTurnHandoff(t *testing.T) {
+	alice, bob, carol := InputId{1, 0}, InputId{2, 0}, InputId{3, 0}
+	chord := []glfw.GamepadButton{glfw.ButtonBack, glfw.ButtonStart}
+	m := newTurnMultiplexer(time.Minute, chord)
+
+	var changes [][2]int
+	m.OnTurn = func(prev, next int) {
+		changes = append(changes, [2]int{prev, next})
+
+		// Whoever gets told about the turn can look at it without waiting on
+		// the multiplexer
+		done := make(chan struct{})
+		go func() {
+			m.Current()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Error("OnTurn was called while the turn was locked")
+		}
+	}
+
+	rules := InputRules{alice: allRules, bob: allRules, carol: allRules}
+	states := StatesMap{alice: resting, bob: resting, carol: resting}
+	chording := func(ids ...InputId) func() {
+		return func() {
+			unmasked := StatesMap{alice: resting, bob: resting, carol: resting}
+			for _, id := range ids {
+				unmasked[id] = gamepad(chord...)
+			}
+			m.WatchChord(unmasked)
+		}
+	}
+
+	steps := []struct {
+		name   string
+		do     func()
+		holder int
+	}{
+		{"first player takes it", func() {}, 1},
+		{"turn isn't over", func() {}, 1},
+		{"out of time", func() { m.started = m.started.Add(-time.Minute) }, 2},
+		{"someone else holds the chord", chording(carol), 2},
+		{"holder presses the chord", chording(bob), 3},
+		{"chord pressed from before the turn", chording(carol), 3},
+		{"chord let go", chording(), 3},
+		{"chord pressed again", chording(carol), 1},
+		{"admin passes it", m.Pass, 2},
+		{"admin gives it", func() { m.Give(1) }, 1},
+		{"admin gives it to nobody", func() { m.Give(9) }, 1},
+		{"holder goes quiet", func() { m.WatchQuiet(map[InputId]bool{alice: true}) }, 2},
+		{"quiet player is skipped", m.Pass, 3},
+		{"quiet player comes back", func() { m.WatchQuiet(nil) }, 3},
+		{"holder disconnects", func() { delete(rules, carol); delete(states, carol) }, 1},
+		{"player without rules is skipped", func() { states[carol] = resting; m.Pass() }, 2},
+		{"everyone leaves", func() { rules = InputRules{} }, -1},
+	}
+	for _, s := range steps {
+		holder := m.Current()
+		changes = nil
+		s.do()
+
+		var multiplexed glfw.GamepadState
+		m.Multiplex(rules, states, &multiplexed)
+		if m.Current() != s.holder {
+			t.Fatalf("%s: turn is with %d, want %d", s.name, m.Current(), s.holder)
+		}
+
+		var want [][2]int
+		if holder != s.holder {
+			want = [][2]int{{holder, s.holder}}
+		}
+		if len(changes) != len(want) || len(want) == 1 && changes[0] != want[0] {
+			t.Fatalf("%s: told about %v, want %v", s.name, changes, want)
+		}
+	}
+}
+
+func TestTurnOnlyHolderDrives(t *testing.T) {
+	alice, alice2, bob := InputId{1, 0}, InputId{1, 1}, InputId{2, 0}
+	m := newTurnMultiplexer(0, nil)
+	rules := InputRules{alice: allRules, alice2: allRules, bob: allRules}
+	states := StatesMap{
+		alice:  gamepad(glfw.ButtonA),
+		alice2: with(resting, glfw.AxisLeftX, 0.5),
+		bob:    gamepad(glfw.ButtonB),
+	}
+
+	// Nobody drives while the turn is being handed over
+	var multiplexed glfw.GamepadState
+	m.Multiplex(rules, states, &multiplexed)
+	if multiplexed != resting {
+		t.Fatalf("multiplexed into %v while handing off the turn, want nothing", multiplexed)
+	}
+
+	// Every joystick of the holder counts
+	m.Multiplex(rules, states, &multiplexed)
+	if want := with(gamepad(glfw.ButtonA), glfw.AxisLeftX, 0.5); !sameGamepad(multiplexed, want) {
+		t.Fatalf("multiplexed into %v, want %v", multiplexed, want)
+	}
+}
+
+func TestTurnAdminCommands(t *testing.T) {
+	alice, bob, carol := InputId{241, 0}, InputId{242, 0}, InputId{243, 0}
+	clientLock.Lock()
+	clients[bob.Client] = &ServerConn{Id: bob.Client, Name: "turn-bob"}
+	clientLock.Unlock()
+	defer func() {
+		clientLock.Lock()
+		delete(clients, bob.Client)
+		clientLock.Unlock()
+	}()
+
+	turns := newTurnMultiplexer(0, nil)
+	core := newCore(turns, nil, time.Second, time.Minute)
+	rules := InputRules{alice: allRules, bob: allRules, carol: allRules}
+	core.states = StatesMap{alice: resting, bob: resting, carol: resting}
+	core.Multiplexer.Multiplex(rules, core.states, &core.multiplexed)
+
+	commands := []struct {
+		command string
+		holder  int
+	}{
+		{"next", 242},
+		{"next", 243},
+		{"give turn-bob", 242},
+		{"give nobody", 242},
+		{"give", 242},
+	}
+	for _, c := range commands {
+		queue := make(chan Event, 1)
+		adminConsole(strings.NewReader(c.command), queue)
+		close(queue)
+		for event := range queue {
+			core.handle(event)
+		}
+
+		core.Multiplexer.Multiplex(rules, core.states, &core.multiplexed)
+		if turns.Current() != c.holder {
+			t.Fatalf("%s: turn is with %d, want %d", c.command, turns.Current(), c.holder)
+		}
+	}
+}
+
+func TestTurnQuietHolder(t *testing.T) {
+	alice, bob := InputId{1, 0}, InputId{2, 0}
+	turns := newTurnMultiplexer(0, nil)
+	core := newCore(turns, nil, time.Second, time.Minute)
+	rules := InputRules{alice: allRules, bob: allRules}
+
+	now := time.Now()
+	core.states = StatesMap{alice: resting, bob: resting}
+	core.seen = map[InputId]time.Time{alice: now, bob: now}
+	turns.WatchQuiet(core.quiet(now))
+	turns.Multiplex(rules, core.states, &core.multiplexed)
+	if turns.Current() != 1 {
+		t.Fatalf("turn is with %d, want 1", turns.Current())
+	}
+
+	// Going quiet passes the turn on long before the joystick is forgotten
+	core.seen[bob] = now.Add(time.Second)
+	later := now.Add(time.Second)
+	core.expire(later)
+	turns.WatchQuiet(core.quiet(later))
+	turns.Multiplex(rules, core.states, &core.multiplexed)
+	if turns.Current() != 2 {
+		t.Fatalf("turn is with %d after its holder went quiet, want 2", turns.Current())
+	}
+	if _, exists := core.states[alice]; !exists {
+		t.Fatal("the quiet joystick was forgotten")
+	}
+}
@@ -0,0 +1,398 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/go-gl/glfw/v3.3/glfw"
+)
+
+// ioctl requests from linux/uinput.h
+const (
+	UI_DEV_CREATE  = 0x5501
+	UI_DEV_DESTROY = 0x5502
+	UI_SET_EVBIT   = 0x40045564
+	UI_SET_KEYBIT  = 0x40045565
+	UI_SET_ABSBIT  = 0x40045567
+	UI_SET_FFBIT   = 0x4004556b
+)
+
+// Requests the game makes to upload or erase force feedback effects
+var (
+	UI_BEGIN_FF_UPLOAD = ioc(iocRead|iocWrite, 'U', 200, unsafe.Sizeof(uinputFFUpload{}))
+	UI_END_FF_UPLOAD   = ioc(iocWrite, 'U', 201, unsafe.Sizeof(uinputFFUpload{}))
+	UI_BEGIN_FF_ERASE  = ioc(iocRead|iocWrite, 'U', 202, unsafe.Sizeof(uinputFFErase{}))
+	UI_END_FF_ERASE    = ioc(iocWrite, 'U', 203, unsafe.Sizeof(uinputFFErase{}))
+)
+
+// Event types and codes from linux/input-event-codes.h
+const (
+	EV_SYN = 0x00
+	EV_KEY = 0x01
+	EV_ABS = 0x03
+
+	SYN_REPORT = 0x00
+
+	EV_UINPUT    = 0x0101
+	UI_FF_UPLOAD = 1
+	UI_FF_ERASE  = 2
+
+	BTN_SOUTH  = 0x130
+	BTN_EAST   = 0x131
+	BTN_NORTH  = 0x133
+	BTN_WEST   = 0x134
+	BTN_TL     = 0x136
+	BTN_TR     = 0x137
+	BTN_SELECT = 0x13a
+	BTN_START  = 0x13b
+	BTN_MODE   = 0x13c
+	BTN_THUMBL = 0x13d
+	BTN_THUMBR = 0x13e
+
+	ABS_X     = 0x00
+	ABS_Y     = 0x01
+	ABS_Z     = 0x02
+	ABS_RX    = 0x03
+	ABS_RY    = 0x04
+	ABS_RZ    = 0x05
+	ABS_HAT0X = 0x10
+	ABS_HAT0Y = 0x11
+
+	BUS_USB = 0x03
+)
+
+// Pretend to be an Xbox 360 controller since every game knows how to use one
+const (
+	UINPUT_NAME    = "gpmux virtual gamepad"
+	UINPUT_VENDOR  = 0x045e
+	UINPUT_PRODUCT = 0x028e
+	UINPUT_VERSION = 0x0110
+
+	STICK_MAX   = 32767
+	TRIGGER_MAX = 255
+
+	// How many rumble effects the game can upload at once
+	UINPUT_FF_EFFECTS = 16
+)
+
+// The key code of each glfw button, the dpad is sent as a hat instead
+var uinputButtons = map[glfw.GamepadButton]uint16{
+	glfw.ButtonA:           BTN_SOUTH,
+	glfw.ButtonB:           BTN_EAST,
+	glfw.ButtonX:           BTN_NORTH,
+	glfw.ButtonY:           BTN_WEST,
+	glfw.ButtonLeftBumper:  BTN_TL,
+	glfw.ButtonRightBumper: BTN_TR,
+	glfw.ButtonBack:        BTN_SELECT,
+	glfw.ButtonStart:       BTN_START,
+	glfw.ButtonGuide:       BTN_MODE,
+	glfw.ButtonLeftThumb:   BTN_THUMBL,
+	glfw.ButtonRightThumb:  BTN_THUMBR,
+}
+
+// The absolute axis code of each glfw axis
+var uinputAxes = map[glfw.GamepadAxis]uint16{
+	glfw.AxisLeftX:        ABS_X,
+	glfw.AxisLeftY:        ABS_Y,
+	glfw.AxisRightX:       ABS_RX,
+	glfw.AxisRightY:       ABS_RY,
+	glfw.AxisLeftTrigger:  ABS_Z,
+	glfw.AxisRightTrigger: ABS_RZ,
+}
+
+// Structs are written to the kernel in the machine's byte order
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// struct input_id
+type inputId struct {
+	Bustype uint16
+	Vendor  uint16
+	Product uint16
+	Version uint16
+}
+
+// struct uinput_user_dev
+type uinputUserDev struct {
+	Name         [80]byte
+	Id           inputId
+	FFEffectsMax uint32
+	Absmax       [64]int32
+	Absmin       [64]int32
+	Absfuzz      [64]int32
+	Absflat      [64]int32
+}
+
+// struct input_event, the kernel fills in the time for us
+type inputEvent struct {
+	Time  syscall.Timeval
+	Type  uint16
+	Code  uint16
+	Value int32
+}
+
+// struct uinput_ff_upload
+type uinputFFUpload struct {
+	RequestId uint32
+	Retval    int32
+	Effect    ffEffect
+	Old       ffEffect
+}
+
+// struct uinput_ff_erase
+type uinputFFErase struct {
+	RequestId uint32
+	Retval    int32
+	EffectId  uint32
+}
+
+// UinputDevice is what a UinputGamepad writes to, normally /dev/uinput.
+// Force feedback requests from the game are read back from it.
+// Anything else implementing it can stand in for the kernel
+type UinputDevice interface {
+	Read(b []byte) (int, error)
+	Write(b []byte) (int, error)
+	Ioctl(request, arg uintptr) error
+	Close() error
+}
+
+// uinputFile is the uinput device opened without blocking. Ioctls go through
+// raw because Fd() would switch the file back to blocking, and then closing
+// it wouldn't wake up the force feedback reader
+type uinputFile struct {
+	*os.File
+	raw syscall.RawConn
+}
+
+func (f uinputFile) Ioctl(request, arg uintptr) error {
+	var errno syscall.Errno
+	err := f.raw.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, request, arg)
+	})
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// UinputGamepad outputs to a virtual Xbox style gamepad made through uinput
+type UinputGamepad struct {
+	dev UinputDevice
+
+	// Rumble effects the game uploaded, by id
+	effects map[int16]Rumble
+	// The kernel reads and writes these while handling a request,
+	// so they have to stay put on the heap
+	upload uinputFFUpload
+	erase  uinputFFErase
+
+	lock     sync.Mutex
+	onRumble func(Rumble)
+}
+
+// openUinputGamepad creates a virtual gamepad using the uinput device at path
+func openUinputGamepad(path string) (Output, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	gamepad, err := newUinputGamepad(uinputFile{file, raw})
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return gamepad, nil
+}
+
+// newUinputGamepad registers the buttons and axes of a gamepad with the
+// device and creates it
+func newUinputGamepad(dev UinputDevice) (*UinputGamepad, error) {
+	// Enable the buttons
+	if err := dev.Ioctl(UI_SET_EVBIT, EV_KEY); err != nil {
+		return nil, err
+	}
+	for _, code := range uinputButtons {
+		if err := dev.Ioctl(UI_SET_KEYBIT, uintptr(code)); err != nil {
+			return nil, err
+		}
+	}
+
+	// Let the game rumble the gamepad
+	if err := dev.Ioctl(UI_SET_EVBIT, EV_FF); err != nil {
+		return nil, err
+	}
+	if err := dev.Ioctl(UI_SET_FFBIT, FF_RUMBLE); err != nil {
+		return nil, err
+	}
+
+	// Enable the axes and describe their ranges
+	if err := dev.Ioctl(UI_SET_EVBIT, EV_ABS); err != nil {
+		return nil, err
+	}
+
+	setup := uinputUserDev{
+		Id: inputId{
+			Bustype: BUS_USB,
+			Vendor:  UINPUT_VENDOR,
+			Product: UINPUT_PRODUCT,
+			Version: UINPUT_VERSION,
+		},
+		FFEffectsMax: UINPUT_FF_EFFECTS,
+	}
+	copy(setup.Name[:], UINPUT_NAME)
+
+	for axis, code := range uinputAxes {
+		if err := dev.Ioctl(UI_SET_ABSBIT, uintptr(code)); err != nil {
+			return nil, err
+		}
+		if isTrigger(axis) {
+			setup.Absmin[code], setup.Absmax[code] = 0, TRIGGER_MAX
+		} else {
+			setup.Absmin[code], setup.Absmax[code] = -STICK_MAX, STICK_MAX
+		}
+	}
+	for _, code := range []uint16{ABS_HAT0X, ABS_HAT0Y} {
+		if err := dev.Ioctl(UI_SET_ABSBIT, uintptr(code)); err != nil {
+			return nil, err
+		}
+		setup.Absmin[code], setup.Absmax[code] = -1, 1
+	}
+
+	buf := &bytes.Buffer{}
+	binary.Write(buf, nativeEndian, &setup)
+	if _, err := dev.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	// Create the gamepad
+	if err := dev.Ioctl(UI_DEV_CREATE, 0); err != nil {
+		return nil, err
+	}
+
+	gamepad := &UinputGamepad{
+		dev:     dev,
+		effects: make(map[int16]Rumble),
+	}
+	// The game waits on us to answer its force feedback requests
+	go gamepad.feedback()
+	return gamepad, nil
+}
+
+// HandleRumble calls handler whenever the game plays or stops a rumble effect
+func (g *UinputGamepad) HandleRumble(handler func(Rumble)) {
+	g.lock.Lock()
+	g.onRumble = handler
+	g.lock.Unlock()
+}
+
+// feedback answers the force feedback requests of the game until the device closes
+func (g *UinputGamepad) feedback() {
+	for {
+		var event inputEvent
+		err := binary.Read(g.dev, nativeEndian, &event)
+		if err != nil {
+			return
+		}
+
+		switch {
+		case event.Type == EV_UINPUT && event.Code == UI_FF_UPLOAD:
+			g.upload = uinputFFUpload{RequestId: uint32(event.Value)}
+			if g.dev.Ioctl(UI_BEGIN_FF_UPLOAD, uintptr(unsafe.Pointer(&g.upload))) != nil {
+				continue
+			}
+			effect := g.upload.Effect
+			g.effects[effect.Id] = Rumble{
+				Strong:   effect.Strong,
+				Weak:     effect.Weak,
+				Duration: time.Duration(effect.Replay[0]) * time.Millisecond,
+			}
+			g.dev.Ioctl(UI_END_FF_UPLOAD, uintptr(unsafe.Pointer(&g.upload)))
+		case event.Type == EV_UINPUT && event.Code == UI_FF_ERASE:
+			g.erase = uinputFFErase{RequestId: uint32(event.Value)}
+			if g.dev.Ioctl(UI_BEGIN_FF_ERASE, uintptr(unsafe.Pointer(&g.erase))) != nil {
+				continue
+			}
+			delete(g.effects, int16(g.erase.EffectId))
+			g.dev.Ioctl(UI_END_FF_ERASE, uintptr(unsafe.Pointer(&g.erase)))
+		case event.Type == EV_FF:
+			effect, exists := g.effects[int16(event.Code)]
+			if !exists {
+				// Gain and autocenter aren't effects
+				continue
+			}
+			if event.Value == 0 {
+				// Stopped
+				effect = Rumble{}
+			}
+
+			g.lock.Lock()
+			handler := g.onRumble
+			g.lock.Unlock()
+			if handler != nil {
+				handler(effect)
+			}
+		}
+	}
+}
+
+// Emit sends the whole state of the gamepad followed by a sync so the game
+// sees every change at once. The kernel drops values that didn't change
+func (g *UinputGamepad) Emit(state *glfw.GamepadState) error {
+	buf := &bytes.Buffer{}
+	write := func(evType, code uint16, value int32) {
+		binary.Write(buf, nativeEndian, &inputEvent{Type: evType, Code: code, Value: value})
+	}
+
+	for button, code := range uinputButtons {
+		write(EV_KEY, code, int32(state.Buttons[button]&glfw.Press))
+	}
+
+	// The dpad is a hat, -1 is left or up and 1 is right or down
+	hatX := int32(state.Buttons[glfw.ButtonDpadRight]&glfw.Press) - int32(state.Buttons[glfw.ButtonDpadLeft]&glfw.Press)
+	hatY := int32(state.Buttons[glfw.ButtonDpadDown]&glfw.Press) - int32(state.Buttons[glfw.ButtonDpadUp]&glfw.Press)
+	write(EV_ABS, ABS_HAT0X, hatX)
+	write(EV_ABS, ABS_HAT0Y, hatY)
+
+	for axis, code := range uinputAxes {
+		value := clamp32(state.Axes[axis], -1, 1)
+		if isTrigger(axis) {
+			// Triggers go from -1 to 1 but the gamepad wants 0 to 255
+			write(EV_ABS, code, int32((value+1)/2*TRIGGER_MAX))
+		} else {
+			write(EV_ABS, code, int32(value*STICK_MAX))
+		}
+	}
+
+	write(EV_SYN, SYN_REPORT, 0)
+
+	_, err := g.dev.Write(buf.Bytes())
+	return err
+}
+
+// Close removes the virtual gamepad
+func (g *UinputGamepad) Close() error {
+	g.dev.Ioctl(UI_DEV_DESTROY, 0)
+	return g.dev.Close()
+}
@@ -0,0 +1,369 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/go-gl/glfw/v3.3/glfw"
+)
+
+// fakeUinputCall is an ioctl or a write the gamepad made, in the order it made them
+type fakeUinputCall struct {
+	Request uintptr
+	Arg     uintptr
+	Written []byte
+}
+
+// fakeUinput records everything written to it and hands out the events it's fed
+type fakeUinput struct {
+	lock    sync.Mutex
+	calls   []fakeUinputCall
+	events  chan []byte
+	onIoctl func(request, arg uintptr) error
+}
+
+func newFakeUinput() *fakeUinput {
+	return &fakeUinput{events: make(chan []byte, 16)}
+}
+
+func (f *fakeUinput) Read(b []byte) (int, error) {
+	event, ok := <-f.events
+	if !ok {
+		return 0, io.EOF
+	}
+	return copy(b, event), nil
+}
+
+func (f *fakeUinput) Write(b []byte) (int, error) {
+	f.lock.Lock()
+	f.calls = append(f.calls, fakeUinputCall{Written: append([]byte{}, b...)})
+	f.lock.Unlock()
+	return len(b), nil
+}
+
+func (f *fakeUinput) Ioctl(request, arg uintptr) error {
+	f.lock.Lock()
+	f.calls = append(f.calls, fakeUinputCall{Request: request, Arg: arg})
+	onIoctl := f.onIoctl
+	f.lock.Unlock()
+	if onIoctl != nil {
+		return onIoctl(request, arg)
+	}
+	return nil
+}
+
+func (f *fakeUinput) Close() error {
+	close(f.events)
+	return nil
+}
+
+// Calls returns everything done to the device so far
+func (f *fakeUinput) Calls() []fakeUinputCall {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]fakeUinputCall{}, f.calls...)
+}
+
+// send feeds the gamepad an event as if the kernel sent it
+func (f *fakeUinput) send(event inputEvent) {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, nativeEndian, &event)
+	f.events <- buf.Bytes()
+}
+
+// readEvents decodes the input_events of a write
+func readEvents(t *testing.T, written []byte) []inputEvent {
+	t.Helper()
+	var events []inputEvent
+	reader := bytes.NewReader(written)
+	for reader.Len() > 0 {
+		var event inputEvent
+		if err := binary.Read(reader, nativeEndian, &event); err != nil {
+			t.Fatalf("write isn't made of input events: %s", err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestUinputSetup(t *testing.T) {
+	dev := newFakeUinput()
+	gamepad, err := newUinputGamepad(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gamepad.Close()
+
+	calls := dev.Calls()
+	if len(calls) < 2 {
+		t.Fatalf("only %d calls made setting up the gamepad", len(calls))
+	}
+
+	// Every bit has to be set before the device is described, and the
+	// device has to be described before it's created
+	keys := make(map[uintptr]bool)
+	abs := make(map[uintptr]bool)
+	var evbits []uintptr
+	var setup []byte
+	for i, call := range calls[:len(calls)-1] {
+		if call.Written != nil {
+			if i != len(calls)-2 {
+				t.Fatalf("device described at call %d before every bit was set", i)
+			}
+			setup = call.Written
+			continue
+		}
+		switch call.Request {
+		case UI_SET_EVBIT:
+			evbits = append(evbits, call.Arg)
+		case UI_SET_KEYBIT:
+			keys[call.Arg] = true
+		case UI_SET_ABSBIT:
+			abs[call.Arg] = true
+		case UI_SET_FFBIT:
+			if call.Arg != FF_RUMBLE {
+				t.Errorf("set force feedback bit %#x, want FF_RUMBLE", call.Arg)
+			}
+		default:
+			t.Errorf("unexpected ioctl %#x during setup", call.Request)
+		}
+	}
+	if last := calls[len(calls)-1]; last.Request != UI_DEV_CREATE {
+		t.Fatalf("last setup call is %#x, want UI_DEV_CREATE", last.Request)
+	}
+
+	if len(evbits) != 3 || evbits[0] != EV_KEY || evbits[1] != EV_FF || evbits[2] != EV_ABS {
+		t.Errorf("event bits %v, want EV_KEY, EV_FF then EV_ABS", evbits)
+	}
+	for button, code := range uinputButtons {
+		if !keys[uintptr(code)] {
+			t.Errorf("button %d's key %#x was never enabled", button, code)
+		}
+	}
+	if len(keys) != len(uinputButtons) {
+		t.Errorf("%d keys enabled, want %d", len(keys), len(uinputButtons))
+	}
+	for _, code := range []uintptr{ABS_X, ABS_Y, ABS_Z, ABS_RX, ABS_RY, ABS_RZ, ABS_HAT0X, ABS_HAT0Y} {
+		if !abs[code] {
+			t.Errorf("axis %#x was never enabled", code)
+		}
+	}
+
+	var described uinputUserDev
+	if err := binary.Read(bytes.NewReader(setup), nativeEndian, &described); err != nil {
+		t.Fatal("setup isn't a uinput_user_dev:", err)
+	}
+	if string(bytes.TrimRight(described.Name[:], "\x00")) != UINPUT_NAME {
+		t.Errorf("named %q, want %q", described.Name, UINPUT_NAME)
+	}
+	if described.Id != (inputId{BUS_USB, UINPUT_VENDOR, UINPUT_PRODUCT, UINPUT_VERSION}) {
+		t.Errorf("id %+v isn't an Xbox 360 controller", described.Id)
+	}
+	if described.FFEffectsMax != UINPUT_FF_EFFECTS {
+		t.Errorf("room for %d effects, want %d", described.FFEffectsMax, UINPUT_FF_EFFECTS)
+	}
+	ranges := map[uint16][2]int32{
+		ABS_X:     {-STICK_MAX, STICK_MAX},
+		ABS_RY:    {-STICK_MAX, STICK_MAX},
+		ABS_Z:     {0, TRIGGER_MAX},
+		ABS_RZ:    {0, TRIGGER_MAX},
+		ABS_HAT0X: {-1, 1},
+	}
+	for code, want := range ranges {
+		if got := [2]int32{described.Absmin[code], described.Absmax[code]}; got != want {
+			t.Errorf("axis %#x goes from %d to %d, want %d to %d", code, got[0], got[1], want[0], want[1])
+		}
+	}
+}
+
+func TestUinputEmit(t *testing.T) {
+	dev := newFakeUinput()
+	gamepad, err := newUinputGamepad(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gamepad.Close()
+	setupCalls := len(dev.Calls())
+
+	state := resting
+	state.Buttons[glfw.ButtonA] = glfw.Press
+	state.Buttons[glfw.ButtonStart] = glfw.Press
+	state.Buttons[glfw.ButtonDpadRight] = glfw.Press
+	state.Buttons[glfw.ButtonDpadUp] = glfw.Press
+	state.Axes[glfw.AxisLeftX] = 0.5
+	state.Axes[glfw.AxisRightY] = -2
+	state.Axes[glfw.AxisRightTrigger] = 1
+	if err := gamepad.Emit(&state); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := dev.Calls()[setupCalls:]
+	if len(calls) != 1 || calls[0].Written == nil {
+		t.Fatalf("emit made %d calls, want a single write", len(calls))
+	}
+	events := readEvents(t, calls[0].Written)
+
+	// Every button and axis is sent, then a sync
+	if want := len(uinputButtons) + 2 + len(uinputAxes) + 1; len(events) != want {
+		t.Fatalf("emitted %d events, want %d", len(events), want)
+	}
+	if last := events[len(events)-1]; last.Type != EV_SYN || last.Code != SYN_REPORT {
+		t.Fatalf("last event %+v isn't a SYN_REPORT", last)
+	}
+
+	got := make(map[[2]uint16]int32)
+	for _, event := range events[:len(events)-1] {
+		got[[2]uint16{event.Type, event.Code}] = event.Value
+	}
+	want := map[[2]uint16]int32{
+		{EV_KEY, BTN_SOUTH}: 1,
+		{EV_KEY, BTN_EAST}:  0,
+		{EV_KEY, BTN_START}: 1,
+		{EV_ABS, ABS_HAT0X}: 1,
+		{EV_ABS, ABS_HAT0Y}: -1,
+		{EV_ABS, ABS_X}:     STICK_MAX / 2,
+		{EV_ABS, ABS_Y}:     0,
+		{EV_ABS, ABS_RY}:    -STICK_MAX,
+		{EV_ABS, ABS_Z}:     0,
+		{EV_ABS, ABS_RZ}:    TRIGGER_MAX,
+	}
+	for key, value := range want {
+		sent, exists := got[key]
+		if !exists {
+			t.Errorf("no event of type %#x code %#x", key[0], key[1])
+		} else if sent != value {
+			t.Errorf("event of type %#x code %#x is %d, want %d", key[0], key[1], sent, value)
+		}
+	}
+}
+
+func TestUinputFeedback(t *testing.T) {
+	dev := newFakeUinput()
+	gamepad, err := newUinputGamepad(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gamepad.Close()
+
+	rumbles := make(chan Rumble, 1)
+	gamepad.HandleRumble(func(effect Rumble) { rumbles <- effect })
+
+	// Play the part of the kernel, handing over the effect the game uploads
+	// and the effect it erases through the structs the gamepad passes in
+	uploads := map[uint32]ffEffect{
+		1: {Type: FF_RUMBLE, Id: 3, Replay: [2]uint16{250, 0}, Strong: 0x8000, Weak: 0x4000},
+		2: {Type: FF_RUMBLE, Id: 4, Replay: [2]uint16{1000, 0}, Strong: 0xFFFF},
+	}
+	erases := map[uint32]uint32{3: 3}
+	var ended []uintptr
+	dev.lock.Lock()
+	dev.onIoctl = func(request, arg uintptr) error {
+		switch request {
+		case UI_BEGIN_FF_UPLOAD:
+			if arg != uintptr(unsafe.Pointer(&gamepad.upload)) {
+				t.Errorf("upload began with %#x, not the gamepad's upload", arg)
+			}
+			gamepad.upload.Effect = uploads[gamepad.upload.RequestId]
+		case UI_BEGIN_FF_ERASE:
+			if arg != uintptr(unsafe.Pointer(&gamepad.erase)) {
+				t.Errorf("erase began with %#x, not the gamepad's erase", arg)
+			}
+			gamepad.erase.EffectId = erases[gamepad.erase.RequestId]
+		case UI_END_FF_UPLOAD, UI_END_FF_ERASE:
+			ended = append(ended, request)
+		}
+		return nil
+	}
+	dev.lock.Unlock()
+
+	expect := func(want Rumble) {
+		t.Helper()
+		select {
+		case effect := <-rumbles:
+			if effect != want {
+				t.Fatalf("rumbled %+v, want %+v", effect, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("never rumbled %+v", want)
+		}
+	}
+
+	dev.send(inputEvent{Type: EV_UINPUT, Code: UI_FF_UPLOAD, Value: 1})
+	dev.send(inputEvent{Type: EV_FF, Code: 3, Value: 1})
+	expect(Rumble{0x8000, 0x4000, 250 * time.Millisecond})
+
+	// Stopping an effect stops the rumble
+	dev.send(inputEvent{Type: EV_FF, Code: 3, Value: 0})
+	expect(Rumble{})
+
+	// Erased effects and ones that were never uploaded don't play, the next
+	// rumble has to come from the effect uploaded after them
+	dev.send(inputEvent{Type: EV_UINPUT, Code: UI_FF_ERASE, Value: 3})
+	dev.send(inputEvent{Type: EV_FF, Code: 3, Value: 1})
+	dev.send(inputEvent{Type: EV_FF, Code: 9, Value: 1})
+	dev.send(inputEvent{Type: EV_UINPUT, Code: UI_FF_UPLOAD, Value: 2})
+	dev.send(inputEvent{Type: EV_FF, Code: 4, Value: 1})
+	expect(Rumble{0xFFFF, 0, time.Second})
+
+	// Every request the game made was answered
+	want := []uintptr{UI_END_FF_UPLOAD, UI_END_FF_ERASE, UI_END_FF_UPLOAD}
+	if len(ended) != len(want) {
+		t.Fatalf("ended %d requests, want %d", len(ended), len(want))
+	}
+	for i := range want {
+		if ended[i] != want[i] {
+			t.Errorf("request %d ended with %#x, want %#x", i, ended[i], want[i])
+		}
+	}
+}
+
+func TestUinputFileClose(t *testing.T) {
+	// A pipe stands in for /dev/uinput, both can be read without blocking
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	raw, err := r.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := uinputFile{r, raw}
+
+	var waiting int32
+	if err := dev.Ioctl(syscall.TIOCINQ, uintptr(unsafe.Pointer(&waiting))); err != nil || waiting != 0 {
+		t.Fatalf("ioctl found %d bytes waiting with error %v", waiting, err)
+	}
+
+	// Closing has to wake up whoever is waiting on the force feedback
+	done := make(chan error, 1)
+	go func() {
+		_, err := dev.Read(make([]byte, 1))
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	dev.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, os.ErrClosed) {
+			t.Fatalf("read ended with %v, want %v", err, os.ErrClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("closing the device didn't wake up the reader")
+	}
+
+	if err := dev.Ioctl(syscall.TIOCINQ, uintptr(unsafe.Pointer(&waiting))); err == nil {
+		t.Fatal("ioctl on a closed device worked")
+	}
+}
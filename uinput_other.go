@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+// openUinputGamepad only works on linux since uinput is part of the linux kernel
+func openUinputGamepad(path string) (Output, error) {
+	return nil, errors.New("gamepad output is only supported on linux")
+}